@@ -0,0 +1,164 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package githubapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// AppResponse is what github returns when querying yourself
+type AppResponse struct {
+	ID   int    `json:"id"`
+	Slug string `json:"slug"`
+}
+
+// InstallationResponse is what github returns when looking up an installation
+type InstallationResponse struct {
+	ID      int64 `json:"id"`
+	Account struct {
+		Login string `json:"login"`
+		Type  string `json:"type"`
+	} `json:"account"`
+	RepositorySelection string `json:"repository_selection"`
+	AppSlug             string `json:"app_slug"`
+}
+
+// TokenResponse is what github returns when gettting an installation token
+type TokenResponse struct {
+	Token               string                    `json:"token"`
+	ExpiresAt           string                    `json:"expires_at"`
+	Permissions         map[string]string         `json:"permissions,omitempty"`
+	RepositorySelection string                    `json:"repository_selection,omitempty"`
+	Repositories        []TokenResponseRepository `json:"repositories,omitempty"`
+}
+
+// TokenResponseRepository represents a repository in the token response
+type TokenResponseRepository struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// RepositoryResponse is what github returns when looking up a repository
+type RepositoryResponse struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Owner    struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+}
+
+// TokenOptions scopes an installation token. Only one of Repositories or
+// RepositoryIDs may be set, and empty options grant everything the
+// installation has access to.
+type TokenOptions struct {
+	Repositories  []string          `json:"repositories,omitempty"`   // Repository names, without the owner
+	RepositoryIDs []int             `json:"repository_ids,omitempty"` // Repository ids
+	Permissions   map[string]string `json:"permissions,omitempty"`    // Permission levels by resource, e.g. contents:read
+}
+
+// empty returns true when the options do not narrow the token
+func (o TokenOptions) empty() bool {
+	return len(o.Repositories) == 0 && len(o.RepositoryIDs) == 0 && len(o.Permissions) == 0
+}
+
+// App retrieves information on the github app to verify the jwt is valid
+func (c *Client) App(ctx context.Context, jwt string) (response AppResponse, err error) {
+	err = c.Do(ctx, "GET", "/app", jwt, nil, &response)
+
+	var ghErr *GitHubError
+	if errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnauthorized {
+		ghErr.Hint = "the app jwt was rejected: check the system clock is correct (clock skew), the private key belongs to the app and has not been deleted, and the app_id or client_id matches the app"
+	}
+	return
+}
+
+// FindInstallation looks up the app installation for a repository, or for an
+// organization or user account when repo is empty
+func (c *Client) FindInstallation(ctx context.Context, jwt, owner, repo string) (response InstallationResponse, err error) {
+	if repo != "" {
+		err = c.Do(ctx, "GET", fmt.Sprintf("/repos/%s/%s/installation", url.PathEscape(owner), url.PathEscape(repo)), jwt, nil, &response)
+		if IsNotFound(err) {
+			err.(*GitHubError).Hint = fmt.Sprintf("the app is not installed on repository %s/%s", owner, repo)
+		}
+		return
+	}
+
+	err = c.Do(ctx, "GET", fmt.Sprintf("/orgs/%s/installation", url.PathEscape(owner)), jwt, nil, &response)
+	if !IsNotFound(err) {
+		return
+	}
+
+	err = c.Do(ctx, "GET", fmt.Sprintf("/users/%s/installation", url.PathEscape(owner)), jwt, nil, &response)
+	if IsNotFound(err) {
+		err.(*GitHubError).Hint = fmt.Sprintf("the app is not installed on organization or user %s", owner)
+	}
+	return
+}
+
+// Installation retrieves an installation of the app by id
+func (c *Client) Installation(ctx context.Context, jwt string, installation int64) (response InstallationResponse, err error) {
+	err = c.Do(ctx, "GET", fmt.Sprintf("/app/installations/%d", installation), jwt, nil, &response)
+	if IsNotFound(err) {
+		err.(*GitHubError).Hint = fmt.Sprintf("installation %d was not found: check the installation id and that the app is still installed", installation)
+	}
+	return
+}
+
+// Repository retrieves a repository by owner and name. Renamed and
+// transferred repositories are followed to their current name.
+func (c *Client) Repository(ctx context.Context, token, owner, repo string) (response RepositoryResponse, err error) {
+	err = c.Do(ctx, "GET", fmt.Sprintf("/repos/%s/%s", url.PathEscape(owner), url.PathEscape(repo)), token, nil, &response)
+	if IsNotFound(err) {
+		err.(*GitHubError).Hint = fmt.Sprintf("repository %s/%s was not found or the installation cannot access it", owner, repo)
+	}
+	return
+}
+
+// CreateInstallationToken returns an installation access token, scoped to the
+// repositories and permissions in opts when set
+func (c *Client) CreateInstallationToken(ctx context.Context, jwt string, installation int64, opts TokenOptions) (response TokenResponse, err error) {
+	var body interface{}
+	if !opts.empty() {
+		body = opts
+	}
+
+	err = c.Do(ctx, "POST", fmt.Sprintf("/app/installations/%d/access_tokens", installation), jwt, body, &response)
+
+	var ghErr *GitHubError
+	if errors.As(err, &ghErr) {
+		switch ghErr.StatusCode {
+		case http.StatusUnauthorized:
+			ghErr.Hint = "the app jwt was rejected: check the system clock is correct and the private key belongs to the app"
+		case http.StatusForbidden:
+			ghErr.Hint = fmt.Sprintf("installation %d is suspended or the app cannot create tokens for it", installation)
+		case http.StatusNotFound:
+			ghErr.Hint = fmt.Sprintf("installation %d was not found: check the installation id and that the app is still installed", installation)
+		case http.StatusUnprocessableEntity:
+			ghErr.Hint = "the requested scope is invalid: check that the permissions are granted to the app and the repositories belong to the installation"
+		}
+		return
+	}
+	if err == nil && response.Token == "" {
+		err = fmt.Errorf("github returned no token for installation %d", installation)
+	}
+	return
+}
+
+// RevokeInstallationToken revokes an installation access token. Revoking a
+// token that is already expired or revoked returns a 401 *GitHubError.
+func (c *Client) RevokeInstallationToken(ctx context.Context, token string) error {
+	err := c.Do(ctx, "DELETE", "/installation/token", token, nil, nil)
+
+	var ghErr *GitHubError
+	if errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnauthorized {
+		ghErr.Hint = "the token is already expired or revoked"
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+// Package githubapp authenticates as a github app and creates installation
+// access tokens, exposed as oauth2 token sources.
+package githubapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultTimeout is the default timeout for each request attempt
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultRetries is the default number of retries for failed requests
+	DefaultRetries = 4
+
+	// retryWaitMin is the initial backoff between retries
+	retryWaitMin = time.Second
+
+	// retryWaitMax caps the backoff between retries, including waits
+	// requested by github through rate limit headers
+	retryWaitMax = time.Minute
+)
+
+// Client makes requests against the github rest api
+type Client struct {
+	// BaseURL is the rest api base url, see NormalizeAPIURL
+	BaseURL string
+
+	// HTTPClient is used for all requests, see NewHTTPClient
+	HTTPClient *http.Client
+}
+
+// NewClient returns a github client for the api base url. A nil httpClient
+// uses NewHTTPClient with default settings.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if baseURL == "" {
+		baseURL = DefaultAPIURL
+	}
+	if httpClient == nil {
+		httpClient = NewHTTPClient(DefaultTimeout, DefaultRetries)
+	}
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: httpClient,
+	}
+}
+
+// NewHTTPClient returns a http client that retries server errors, network
+// errors and rate limited requests with exponential backoff, limiting each
+// attempt by timeout
+func NewHTTPClient(timeout time.Duration, retries int) *http.Client {
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Timeout = timeout
+	client.RetryMax = retries
+	client.RetryWaitMin = retryWaitMin
+	client.RetryWaitMax = retryWaitMax
+	client.CheckRetry = checkRetry
+	client.Backoff = backoff
+	client.ErrorHandler = lastResponse
+	client.Logger = nil
+	client.RequestLogHook = logRetry
+	client.ResponseLogHook = logRateLimit
+
+	return client.StandardClient()
+}
+
+// NewRetryClient returns a http client for services other than github that
+// retries network errors, server errors and 429 responses with exponential
+// backoff, limiting each attempt by timeout
+func NewRetryClient(timeout time.Duration, retries int) *http.Client {
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Timeout = timeout
+	client.RetryMax = retries
+	client.RetryWaitMin = retryWaitMin
+	client.RetryWaitMax = retryWaitMax
+	client.ErrorHandler = lastResponse
+	client.Logger = nil
+	client.RequestLogHook = logRetry
+
+	return client.StandardClient()
+}
+
+// methodKey is the context key for the request method, so checkRetry knows
+// the method of requests that failed without a response
+type methodKey struct{}
+
+// Do makes a request to the github api path authenticated with token (an app
+// jwt or an installation token), encoding body as json when set and decoding
+// a successful response into out. Error responses are returned as a
+// *GitHubError.
+func (c *Client) Do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	url := c.BaseURL + path
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, methodKey{}, method), method, url, reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newGitHubError(resp, data)
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("unable to decode response from %s: %v", url, err)
+	}
+	return nil
+}
+
+// checkRetry retries network errors and server errors like the default
+// policy, and additionally retries primary and secondary rate limits when
+// github asks us to wait no longer than retryWaitMax. POST requests, which
+// create tokens, are only retried when github cannot have processed them.
+func checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if method, _ := ctx.Value(methodKey{}).(string); method == "POST" && (err != nil || resp.StatusCode >= 500) {
+		// a server error or a lost response may still have created a token
+		var opErr *net.OpError
+		if ctx.Err() == nil && err != nil && errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true, nil
+		}
+		return false, nil
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	if wait, limited := rateLimitWait(resp); limited {
+		if wait > retryWaitMax {
+			log.Println(fmt.Sprintf("rate limited by github until %s, not retrying", time.Now().Add(wait).Format(time.RFC3339)))
+			return false, nil
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// backoff waits as long as github asks for rate limited requests, otherwise
+// it backs off exponentially with jitter
+func backoff(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if wait, limited := rateLimitWait(resp); limited {
+			return wait
+		}
+	}
+
+	wait := min << uint(attempt)
+	if wait <= 0 || wait > max {
+		wait = max
+	}
+
+	// full jitter over the upper half of the window
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// rateLimitWait returns how long github asks us to wait before retrying a
+// rate limited response, based on the Retry-After and X-RateLimit-Reset
+// headers
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			wait := time.Until(time.Unix(reset, 0))
+			if wait < 0 {
+				wait = 0
+			}
+			return wait, true
+		}
+	}
+
+	// secondary rate limits without headers should wait at least a minute
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return retryWaitMax, true
+	}
+
+	return 0, false
+}
+
+// lastResponse returns the final response once retries are exhausted so the
+// github error can be reported, or the error when there was no response
+func lastResponse(resp *http.Response, err error, attempts int) (*http.Response, error) {
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, fmt.Errorf("giving up after %d attempt(s): %v", attempts, err)
+}
+
+// logRetry logs each retry of a request
+func logRetry(_ retryablehttp.Logger, req *http.Request, attempt int) {
+	if attempt > 0 {
+		log.Println(fmt.Sprintf("retrying %s %s (attempt %d)", req.Method, req.URL, attempt+1))
+	}
+}
+
+// logRateLimit logs the remaining github rate limit for each response
+func logRateLimit(_ retryablehttp.Logger, resp *http.Response) {
+	remaining := resp.Header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		return
+	}
+
+	logrus.Debugf("github rate limit: %s of %s remaining, resets %s", remaining, resp.Header.Get("X-RateLimit-Limit"), resp.Header.Get("X-RateLimit-Reset"))
+	if count, err := strconv.Atoi(remaining); err == nil && count < 100 {
+		log.Println(fmt.Sprintf("github rate limit is low: %d requests remaining", count))
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package githubapp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GitHubError is returned when the github api responds with an error status
+type GitHubError struct {
+	StatusCode       int    `json:"-"`
+	Method           string `json:"-"`
+	URL              string `json:"-"`
+	Message          string `json:"message"`
+	DocumentationURL string `json:"documentation_url"`
+	RequestID        string `json:"-"`
+
+	// Hint is an actionable explanation of the error, set by the caller
+	// that knows what the request was for
+	Hint string `json:"-"`
+}
+
+// newGitHubError builds an error from a github error response
+func newGitHubError(resp *http.Response, body []byte) *GitHubError {
+	ghErr := &GitHubError{}
+	// the body is not guaranteed to be json (proxies, load balancers)
+	if json.Unmarshal(body, ghErr) != nil {
+		ghErr.Message = strings.TrimSpace(string(body))
+	}
+
+	ghErr.StatusCode = resp.StatusCode
+	ghErr.RequestID = resp.Header.Get("X-GitHub-Request-Id")
+	if resp.Request != nil {
+		ghErr.Method = resp.Request.Method
+		ghErr.URL = resp.Request.URL.String()
+	}
+	if ghErr.Message == "" {
+		ghErr.Message = http.StatusText(resp.StatusCode)
+	}
+
+	return ghErr
+}
+
+func (e *GitHubError) Error() string {
+	msg := fmt.Sprintf("github returned %d %s", e.StatusCode, e.Message)
+	if e.Method != "" {
+		msg = fmt.Sprintf("%s %s: %s", e.Method, e.URL, msg)
+	}
+	if e.Hint != "" {
+		msg += ": " + e.Hint
+	}
+	if e.DocumentationURL != "" {
+		msg += fmt.Sprintf(" (see %s)", e.DocumentationURL)
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" [request id %s]", e.RequestID)
+	}
+	return msg
+}
+
+// IsNotFound returns true if err is a github 404 response
+func IsNotFound(err error) bool {
+	var ghErr *GitHubError
+	return errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusNotFound
+}
+
+// IsUnauthorized returns true if err is a github 401 response, e.g. when the
+// jwt was signed with a key removed from the app
+func IsUnauthorized(err error) bool {
+	var ghErr *GitHubError
+	return errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnauthorized
+}
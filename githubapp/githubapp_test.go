@@ -0,0 +1,315 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+var noContext = context.Background()
+
+func TestFindInstallation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/octocat/hello-world/installation":
+			w.Write([]byte(`{"id": 1, "account": {"login": "octocat"}}`))
+		case "/users/octocat/installation":
+			w.Write([]byte(`{"id": 2, "account": {"login": "octocat"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	defer server.Close()
+
+	github := NewClient(server.URL, NewHTTPClient(time.Second, 0))
+
+	installation, err := github.FindInstallation(noContext, "jwt", "octocat", "hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installation.ID != 1 {
+		t.Errorf("want repository installation 1, got %d", installation.ID)
+	}
+
+	installation, err = github.FindInstallation(noContext, "jwt", "octocat", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installation.ID != 2 {
+		t.Errorf("want user installation 2, got %d", installation.ID)
+	}
+
+	if _, err = github.FindInstallation(noContext, "jwt", "octocat", "missing"); err == nil {
+		t.Errorf("want error for repository without installation")
+	}
+}
+
+func TestRepository(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/octocat/old-name":
+			// renamed repositories redirect to the repository id
+			http.Redirect(w, r, "/repositories/42", http.StatusMovedPermanently)
+		case "/repositories/42":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"id": 42, "name": "new-name", "full_name": "octocat/new-name", "owner": {"login": "octocat"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	defer server.Close()
+
+	github := NewClient(server.URL, NewHTTPClient(time.Second, 0))
+
+	repo, err := github.Repository(noContext, "token", "octocat", "old-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.ID != 42 || repo.Name != "new-name" || repo.Owner.Login != "octocat" {
+		t.Errorf("want renamed repository 42, got %+v", repo)
+	}
+
+	_, err = github.Repository(noContext, "token", "octocat", "missing")
+	if !IsNotFound(err) {
+		t.Errorf("want not found error, got %v", err)
+	}
+}
+
+func TestInstallationTokenErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/installations/1/access_tokens":
+			w.Header().Set("X-GitHub-Request-Id", "ABCD:1234")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"message": "The permissions requested are not granted to this installation.", "documentation_url": "https://docs.github.com"}`))
+		case "/app/installations/2/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	defer server.Close()
+
+	github := NewClient(server.URL, NewHTTPClient(time.Second, 0))
+
+	_, err := github.CreateInstallationToken(noContext, "jwt", 1, TokenOptions{Permissions: map[string]string{"administration": "write"}})
+	ghErr, ok := err.(*GitHubError)
+	if !ok {
+		t.Fatalf("want *GitHubError, got %T: %v", err, err)
+	}
+	if ghErr.StatusCode != http.StatusUnprocessableEntity || ghErr.RequestID != "ABCD:1234" || ghErr.DocumentationURL != "https://docs.github.com" {
+		t.Errorf("unexpected error details: %+v", ghErr)
+	}
+	if ghErr.Hint == "" {
+		t.Errorf("want hint for 422 response")
+	}
+
+	if _, err = github.CreateInstallationToken(noContext, "jwt", 2, TokenOptions{}); err == nil {
+		t.Errorf("want error when no token is returned")
+	}
+
+	if _, err = github.CreateInstallationToken(noContext, "jwt", 3, TokenOptions{}); !IsNotFound(err) {
+		t.Errorf("want not found error, got %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "You have exceeded a secondary rate limit."}`))
+		default:
+			w.Write([]byte(`{"id": 1, "slug": "octo-app"}`))
+		}
+	}))
+	defer server.Close()
+
+	github := NewClient(server.URL, NewHTTPClient(time.Second, 2))
+	app, err := github.App(noContext, "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Slug != "octo-app" || attempts != 3 {
+		t.Errorf("want octo-app after 3 attempts, got %q after %d", app.Slug, attempts)
+	}
+
+	// a server error creating a token may have created it, so it is not
+	// retried, while rate limits are
+	attempts = 0
+	if _, err = github.CreateInstallationToken(noContext, "jwt", 1, TokenOptions{}); err == nil || attempts != 1 {
+		t.Errorf("want token creation failed without retry, got %v after %d attempts", err, attempts)
+	}
+	attempts = 1
+	if _, err = github.CreateInstallationToken(noContext, "jwt", 1, TokenOptions{}); err == nil || attempts != 3 {
+		t.Errorf("want rate limited token creation retried, got %v after %d attempts", err, attempts)
+	}
+
+	// other services get a plain retrying client without rate limit handling
+	attempts = 0
+	resp, err := NewRetryClient(time.Second, 2).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || attempts != 2 {
+		t.Errorf("want 403 returned after 2 attempts, got %d after %d", resp.StatusCode, attempts)
+	}
+}
+
+func TestInstallationTokenSource(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/installations/1/access_tokens" || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		created++
+		// the first token is close to expiry and must be refreshed
+		expires := time.Now().Add(time.Minute)
+		if created > 1 {
+			expires = time.Now().Add(time.Hour)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_token", "expires_at": "` + expires.UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	app := NewAppTokenSource("Iv1.test", key)
+	source := NewInstallationTokenSource(NewClient(server.URL, nil), app, 1, TokenOptions{})
+
+	for i := 0; i < 3; i++ {
+		token, err := source.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "ghs_token" {
+			t.Errorf("want ghs_token, got %s", token.AccessToken)
+		}
+	}
+	if created != 2 {
+		t.Errorf("want token created twice, refreshed once before expiry, got %d", created)
+	}
+}
+
+// TestInstallationTokenSourceConcurrent is meant to be run with -race, like
+// the command refresher and the caller sharing a source
+func TestInstallationTokenSourceConcurrent(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every token is within the refresh window, so each call refreshes
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_token", "expires_at": "` + time.Now().Add(time.Minute).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	source := NewInstallationTokenSource(NewClient(server.URL, nil), NewAppTokenSource("Iv1.test", key), 1, TokenOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				var token *oauth2.Token
+				token, err = source.Token()
+				if err == nil && token.Expiry.IsZero() {
+					t.Errorf("want token expiry set")
+				}
+			} else {
+				_, err = source.InstallationToken()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// testSigner is a crypto.Signer that does not expose the private key, like a
+// kms or hsm key
+type testSigner struct {
+	key    *rsa.PrivateKey
+	signed int
+}
+
+func (s *testSigner) Public() crypto.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *testSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.signed++
+	return rsa.SignPKCS1v15(rand, s.key, opts.HashFunc(), digest)
+}
+
+func TestAppTokenSourceSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &testSigner{key: key}
+
+	source := NewAppTokenSource("Iv1.test", signer)
+	token, err := source.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = source.Token(); err != nil || signer.signed != 1 {
+		t.Errorf("want jwt reused until close to expiry, signed %d times", signer.signed)
+	}
+
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(token.AccessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	if err != nil || !parsed.Valid || parsed.Method != jwt.SigningMethodRS256 {
+		t.Fatalf("want valid RS256 jwt, got %v", err)
+	}
+	if claims["iss"] != "Iv1.test" {
+		t.Errorf("want issuer Iv1.test, got %v", claims["iss"])
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err = NewAppTokenSource("Iv1.test", ecKey).Token(); err == nil {
+		t.Errorf("want non-rsa signer to be rejected")
+	}
+}
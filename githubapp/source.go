@@ -0,0 +1,224 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// DefaultJWTExpiration is the lifetime of app jwts, the maximum github allows
+	DefaultJWTExpiration = 10 * time.Minute
+
+	// DefaultRefreshBefore is how long before expiry cached tokens are refreshed
+	DefaultRefreshBefore = 5 * time.Minute
+
+	// jwtClockDrift backdates the jwt issue time to allow for clock drift
+	// between us and github
+	jwtClockDrift = time.Minute
+)
+
+// AppTokenSource is an oauth2.TokenSource of jwts that authenticate as the
+// github app. Tokens are reused until they are close to expiry.
+type AppTokenSource struct {
+	// Issuer is the app client id (preferred) or app id
+	Issuer string
+
+	// Key signs the jwts with the app private key. It can be an
+	// *rsa.PrivateKey or any crypto.Signer with an rsa public key, e.g. a key
+	// held in a kms or hsm.
+	Key crypto.Signer
+
+	// Expiration is the jwt lifetime, defaults to DefaultJWTExpiration
+	Expiration time.Duration
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// NewAppTokenSource returns a token source of app jwts for the issuer
+func NewAppTokenSource(issuer string, key crypto.Signer) *AppTokenSource {
+	return &AppTokenSource{Issuer: issuer, Key: key}
+}
+
+// Token returns a signed app jwt, signing a new one when the cached jwt
+// expires within a minute
+func (s *AppTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && time.Until(s.token.Expiry) > time.Minute {
+		return s.token, nil
+	}
+
+	if s.Issuer == "" {
+		return nil, errors.New("githubapp: app token source requires an issuer")
+	}
+	if s.Key == nil {
+		return nil, errors.New("githubapp: app token source requires a private key")
+	}
+
+	expiration := s.Expiration
+	if expiration <= 0 {
+		expiration = DefaultJWTExpiration
+	}
+
+	now := time.Now()
+	expiry := now.Add(expiration)
+	signed, err := signJWT(s.Key, map[string]interface{}{
+		"iat": now.Add(-jwtClockDrift).Unix(),
+		"exp": expiry.Unix(),
+		"iss": s.Issuer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.token = &oauth2.Token{
+		AccessToken: signed,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}
+	return s.token, nil
+}
+
+// signJWT returns an RS256 jwt with the claims, signed by key
+func signJWT(key crypto.Signer, claims map[string]interface{}) (string, error) {
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return "", fmt.Errorf("githubapp: app jwts must be signed with an rsa key, got %T", key.Public())
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("githubapp: unable to sign app jwt: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// InstallationTokenSource is an oauth2.TokenSource of installation access
+// tokens. Tokens are reused until RefreshBefore their expires_at.
+type InstallationTokenSource struct {
+	// Client makes the github api requests
+	Client *Client
+
+	// App provides the app jwts used to create installation tokens
+	App oauth2.TokenSource
+
+	// InstallationID is the installation to create tokens for
+	InstallationID int64
+
+	// Options scopes the tokens to repositories and permissions
+	Options TokenOptions
+
+	// RefreshBefore is how long before expiry tokens are refreshed, defaults
+	// to DefaultRefreshBefore
+	RefreshBefore time.Duration
+
+	// Context is used for api requests, defaults to context.Background
+	Context context.Context
+
+	mu       sync.Mutex
+	response *TokenResponse
+	expiry   time.Time
+}
+
+// NewInstallationTokenSource returns a token source of installation tokens
+func NewInstallationTokenSource(client *Client, app oauth2.TokenSource, installation int64, opts TokenOptions) *InstallationTokenSource {
+	return &InstallationTokenSource{
+		Client:         client,
+		App:            app,
+		InstallationID: installation,
+		Options:        opts,
+	}
+}
+
+// Token returns an installation access token
+func (s *InstallationTokenSource) Token() (*oauth2.Token, error) {
+	response, expiry, err := s.installationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken: response.Token,
+		TokenType:   "Bearer",
+		Expiry:      expiry,
+	}
+	return token.WithExtra(map[string]interface{}{
+		"permissions":          response.Permissions,
+		"repository_selection": response.RepositorySelection,
+		"repositories":         response.Repositories,
+	}), nil
+}
+
+// InstallationToken returns the full github response for an installation
+// access token, creating a new token when the cached one is close to expiry
+func (s *InstallationTokenSource) InstallationToken() (TokenResponse, error) {
+	response, _, err := s.installationToken()
+	return response, err
+}
+
+// installationToken returns the token and its expiry, both read while
+// holding the lock as they change when the token is refreshed
+func (s *InstallationTokenSource) installationToken() (TokenResponse, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refreshBefore := s.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = DefaultRefreshBefore
+	}
+
+	if s.response != nil && time.Until(s.expiry) > refreshBefore {
+		return *s.response, s.expiry, nil
+	}
+
+	ctx := s.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	appToken, err := s.App.Token()
+	if err != nil {
+		return TokenResponse{}, time.Time{}, err
+	}
+
+	response, err := s.Client.CreateInstallationToken(ctx, appToken.AccessToken, s.InstallationID, s.Options)
+	if err != nil {
+		return TokenResponse{}, time.Time{}, err
+	}
+
+	expiry, err := time.Parse(time.RFC3339, response.ExpiresAt)
+	if err != nil {
+		return TokenResponse{}, time.Time{}, fmt.Errorf("githubapp: invalid token expires_at '%s': %v", response.ExpiresAt, err)
+	}
+
+	s.response = &response
+	s.expiry = expiry
+	return response, expiry, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package githubapp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultAPIURL is the rest api for github.com
+const DefaultAPIURL = "https://api.github.com"
+
+// NormalizeAPIURL converts a github web or api url into an api base url
+//   - github.com and api.github.com use https://api.github.com
+//   - data residency tenants (<tenant>.ghe.com) use https://api.<tenant>.ghe.com
+//   - github enterprise server hosts use https://<host>/api/v3
+func NormalizeAPIURL(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid api_url '%s': %v", raw, err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid api_url '%s': missing host", raw)
+	}
+
+	host := strings.ToLower(u.Host)
+	path := strings.TrimRight(u.Path, "/")
+
+	switch {
+	case host == "github.com" || host == "api.github.com":
+		return DefaultAPIURL, nil
+	case strings.HasSuffix(host, ".ghe.com"):
+		if !strings.HasPrefix(host, "api.") {
+			host = "api." + host
+		}
+		return fmt.Sprintf("%s://%s", u.Scheme, host), nil
+	case path == "":
+		path = "/api/v3"
+	}
+
+	return fmt.Sprintf("%s://%s%s", u.Scheme, host, path), nil
+}
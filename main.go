@@ -6,6 +6,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.om/rssnyder/drone-github-app/plugin"
 
@@ -30,7 +34,40 @@ func main() {
 		logrus.SetLevel(logrus.TraceLevel)
 	}
 
+	// git credential helper, e.g. git config credential.helper "/bin/plugin git-credential"
+	if len(os.Args) > 1 && os.Args[1] == "git-credential" {
+		if len(os.Args) < 3 {
+			logrus.Fatalln("usage: git-credential <get|store|erase>")
+		}
+		if err := plugin.GitCredential(context.Background(), args, os.Args[2], os.Stdin, os.Stdout); err != nil {
+			logrus.Fatalln(err)
+		}
+		return
+	}
+
+	// token broker, e.g. /bin/plugin serve
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := plugin.Serve(ctx, args); err != nil {
+			logrus.Fatalln(err)
+		}
+		return
+	}
+
+	// arguments after "--" are a command to run with the token
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args.CommandArgs = os.Args[i+1:]
+			break
+		}
+	}
+
 	if err := plugin.Exec(context.Background(), args); err != nil {
+		var exitErr *plugin.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		logrus.Fatalln(err)
 	}
 }
@@ -0,0 +1,187 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// awsConfig loads the aws config with the default credential chain, unless
+// aws_access_key_id is set. The endpoint can be overridden with aws_endpoint,
+// e.g. for localstack.
+func awsConfig(ctx context.Context, args Args) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithHTTPClient(awshttp.NewBuildableClient().WithTimeout(args.HTTPTimeout)),
+		config.WithRetryMaxAttempts(args.HTTPRetries + 1),
+	}
+	if args.AWSRegion != "" {
+		opts = append(opts, config.WithRegion(args.AWSRegion))
+	}
+	if args.AWSAccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			args.AWSAccessKeyID, args.AWSSecretAccessKey, args.AWSSessionToken)))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to load aws config: %v", err)
+	}
+	if cfg.Region == "" {
+		return cfg, errors.New("aws_region must be set to use aws")
+	}
+	if args.AWSEndpoint != "" {
+		cfg.BaseEndpoint = aws.String(args.AWSEndpoint)
+	}
+	return cfg, nil
+}
+
+// awsTag is a resource tag
+type awsTag struct {
+	Key   string
+	Value string
+}
+
+// awsTags returns the aws_tags setting with the expiry of the secret
+func awsTags(args Args, secret Secret) ([]awsTag, error) {
+	values, err := parseKeyValues(args.AWSTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid aws_tags: %v", err)
+	}
+	values["drone-github-app:kind"] = secret.Kind
+	if !secret.ExpiresAt.IsZero() {
+		values["drone-github-app:expires-at"] = secret.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	var tags []awsTag
+	for key, value := range values {
+		tags = append(tags, awsTag{Key: key, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags, nil
+}
+
+// secretsManagerSink stores secrets in aws secrets manager
+type secretsManagerSink struct {
+	client *secretsmanager.Client
+	args   Args
+}
+
+func newSecretsManagerSink(ctx context.Context, args Args) (*secretsManagerSink, error) {
+	cfg, err := awsConfig(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &secretsManagerSink{client: secretsmanager.NewFromConfig(cfg), args: args}, nil
+}
+
+func (s *secretsManagerSink) Name() string {
+	return "aws secrets manager"
+}
+
+// Store creates the secret, or puts a new value when it already exists
+func (s *secretsManagerSink) Store(ctx context.Context, secret Secret) error {
+	tags, err := awsTags(s.args, secret)
+	if err != nil {
+		return err
+	}
+	var smTags []smtypes.Tag
+	for _, tag := range tags {
+		smTags = append(smTags, smtypes.Tag{Key: aws.String(tag.Key), Value: aws.String(tag.Value)})
+	}
+
+	create := &secretsmanager.CreateSecretInput{
+		Name:         aws.String(secret.ID),
+		SecretString: aws.String(secret.Value),
+		Tags:         smTags,
+	}
+	if s.args.AWSKMSKeyID != "" {
+		create.KmsKeyId = aws.String(s.args.AWSKMSKeyID)
+	}
+	_, err = s.client.CreateSecret(ctx, create)
+	var exists *smtypes.ResourceExistsException
+	if !errors.As(err, &exists) {
+		return err
+	}
+
+	update := &secretsmanager.UpdateSecretInput{
+		SecretId:     aws.String(secret.ID),
+		SecretString: aws.String(secret.Value),
+	}
+	if s.args.AWSKMSKeyID != "" {
+		update.KmsKeyId = aws.String(s.args.AWSKMSKeyID)
+	}
+	if _, err = s.client.UpdateSecret(ctx, update); err != nil {
+		return err
+	}
+	_, err = s.client.TagResource(ctx, &secretsmanager.TagResourceInput{
+		SecretId: aws.String(secret.ID),
+		Tags:     smTags,
+	})
+	return err
+}
+
+// ssmSink stores secrets as ssm parameter store secure strings
+type ssmSink struct {
+	client *ssm.Client
+	args   Args
+}
+
+func newSSMSink(ctx context.Context, args Args) (*ssmSink, error) {
+	cfg, err := awsConfig(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &ssmSink{client: ssm.NewFromConfig(cfg), args: args}, nil
+}
+
+func (s *ssmSink) Name() string {
+	return "aws ssm"
+}
+
+// Store puts the parameter, overwriting any existing value. Tags cannot be
+// set when overwriting so they are added afterwards.
+func (s *ssmSink) Store(ctx context.Context, secret Secret) error {
+	tags, err := awsTags(s.args, secret)
+	if err != nil {
+		return err
+	}
+
+	put := &ssm.PutParameterInput{
+		Name:      aws.String(secret.ID),
+		Value:     aws.String(secret.Value),
+		Type:      ssmtypes.ParameterTypeSecureString,
+		Overwrite: aws.Bool(true),
+	}
+	if s.args.AWSKMSKeyID != "" {
+		put.KeyId = aws.String(s.args.AWSKMSKeyID)
+	}
+	if _, err = s.client.PutParameter(ctx, put); err != nil {
+		return err
+	}
+
+	var ssmTags []ssmtypes.Tag
+	for _, tag := range tags {
+		ssmTags = append(ssmTags, ssmtypes.Tag{Key: aws.String(tag.Key), Value: aws.String(tag.Value)})
+	}
+	_, err = s.client.AddTagsToResource(ctx, &ssm.AddTagsToResourceInput{
+		ResourceType: ssmtypes.ResourceTypeForTaggingParameter,
+		ResourceId:   aws.String(secret.ID),
+		Tags:         ssmTags,
+	})
+	return err
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// tokenCache keeps installation tokens on disk so they can be reused by
+// later steps and parallel stages instead of creating a new token each time
+type tokenCache struct {
+	dir         string
+	passphrase  string
+	minLifetime time.Duration
+}
+
+// cacheKeyIterations is the pbkdf2 work factor for the cache encryption key,
+// each entry has its own salt so the key is derived on every read and write
+const cacheKeyIterations = 100000
+
+// encryptedEntry is the on disk format of an encrypted cache entry
+type encryptedEntry struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// newTokenCache returns a cache in dir. Entries are encrypted when
+// passphrase is set, and only returned while they have more than
+// minLifetime left before they expire.
+func newTokenCache(dir, passphrase string, minLifetime time.Duration) *tokenCache {
+	return &tokenCache{dir: dir, passphrase: passphrase, minLifetime: minLifetime}
+}
+
+// tokenCacheKey identifies tokens created by the same app for the same
+// installation and scope
+func tokenCacheKey(apiURL, issuer string, installation int64, opts githubapp.TokenOptions) string {
+	repositories := append([]string{}, opts.Repositories...)
+	sort.Strings(repositories)
+
+	var ids []string
+	for _, id := range opts.RepositoryIDs {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	sort.Strings(ids)
+
+	var permissions []string
+	for resource, permission := range opts.Permissions {
+		permissions = append(permissions, resource+":"+permission)
+	}
+	sort.Strings(permissions)
+
+	return strings.Join([]string{
+		apiURL,
+		issuer,
+		strconv.FormatInt(installation, 10),
+		strings.Join(repositories, ","),
+		strings.Join(ids, ","),
+		strings.Join(permissions, ","),
+	}, "\n")
+}
+
+// get returns the cached token for key when it has enough lifetime left
+func (c *tokenCache) get(key string) (token githubapp.TokenResponse, ok bool) {
+	token, err := c.read(c.path(key))
+	if err != nil {
+		return token, false
+	}
+
+	expiry, err := time.Parse(time.RFC3339, token.ExpiresAt)
+	if err != nil || time.Until(expiry) <= c.minLifetime {
+		return token, false
+	}
+	return token, true
+}
+
+// put stores the token for key, readable only by the current user
+func (c *tokenCache) put(key string, token githubapp.TokenResponse) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	if c.passphrase != "" {
+		if data, err = c.encrypt(data); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path(key), data, 0600)
+}
+
+// read returns the token in a cache file
+func (c *tokenCache) read(path string) (token githubapp.TokenResponse, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return token, err
+	}
+
+	if c.passphrase != "" {
+		if data, err = c.decrypt(data); err != nil {
+			return token, err
+		}
+	}
+
+	if err = json.Unmarshal(data, &token); err != nil {
+		return token, err
+	}
+	if token.Token == "" {
+		return token, errors.New("cache entry has no token")
+	}
+	return token, nil
+}
+
+// remove deletes the token for key
+func (c *tokenCache) remove(key string) error {
+	err := os.Remove(c.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeToken deletes every entry holding token, e.g. once it is revoked, and
+// returns how many were deleted. Entries that cannot be read, e.g. encrypted
+// with another passphrase, are left alone.
+func (c *tokenCache) removeToken(token string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, path := range paths {
+		if cached, err := c.read(path); err != nil || cached.Token != token {
+			continue
+		}
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// path returns the cache file for key, hashed so the file name does not
+// reveal the installation or scope
+func (c *tokenCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *tokenCache) encrypt(data []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := c.gcm(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encryptedEntry{
+		Salt:  salt,
+		Nonce: nonce,
+		Data:  gcm.Seal(nil, nonce, data, nil),
+	})
+}
+
+func (c *tokenCache) decrypt(data []byte) ([]byte, error) {
+	var entry encryptedEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	if len(entry.Salt) == 0 {
+		return nil, errors.New("cache entry has no salt")
+	}
+
+	gcm, err := c.gcm(entry.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid cache entry nonce")
+	}
+
+	plain, err := gcm.Open(nil, entry.Nonce, entry.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt cache entry: %v", err)
+	}
+	return plain, nil
+}
+
+// gcm returns the aes-256-gcm cipher for an entry, keyed with the passphrase
+// and the entry's salt
+func (c *tokenCache) gcm(salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, c.passphrase, salt, cacheKeyIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
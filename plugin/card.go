@@ -0,0 +1,65 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"sort"
+	"strconv"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// cardSchema is the adaptive card template rendering Card
+const cardSchema = "https://raw.githubusercontent.com/rssnyder/drone-github-app/main/card.json"
+
+// Card summarizes the credentials created by the step. It must never
+// include the jwt or token.
+type Card struct {
+	App                 string           `json:"app"`
+	Installation        string           `json:"installation,omitempty"`
+	Account             string           `json:"account,omitempty"`
+	AccountType         string           `json:"account_type,omitempty"`
+	RepositorySelection string           `json:"repository_selection,omitempty"`
+	Repositories        []string         `json:"repositories,omitempty"`
+	Permissions         []CardPermission `json:"permissions,omitempty"`
+	ExpiresAt           string           `json:"expires_at,omitempty"`
+	Cached              bool             `json:"cached"`
+	Outputs             []string         `json:"outputs,omitempty"`
+}
+
+// CardPermission is a permission granted to the token
+type CardPermission struct {
+	Resource string `json:"resource"`
+	Level    string `json:"level"`
+}
+
+// newCard builds the card for the app, installation and token
+func newCard(app githubapp.AppResponse, installation githubapp.InstallationResponse, token githubapp.TokenResponse, cached bool, outputs []string) Card {
+	card := Card{
+		App:                 app.Slug,
+		Account:             installation.Account.Login,
+		AccountType:         installation.Account.Type,
+		RepositorySelection: token.RepositorySelection,
+		ExpiresAt:           token.ExpiresAt,
+		Cached:              cached,
+		Outputs:             outputs,
+	}
+	if installation.ID != 0 {
+		card.Installation = strconv.FormatInt(installation.ID, 10)
+	}
+
+	for _, repo := range token.Repositories {
+		card.Repositories = append(card.Repositories, repo.Name)
+	}
+
+	for resource, level := range token.Permissions {
+		card.Permissions = append(card.Permissions, CardPermission{Resource: resource, Level: level})
+	}
+	sort.Slice(card.Permissions, func(i, j int) bool {
+		return card.Permissions[i].Resource < card.Permissions[j].Resource
+	})
+
+	return card
+}
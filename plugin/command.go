@@ -0,0 +1,226 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// ExitError is returned when a command run by the plugin exits non-zero, so
+// the plugin can exit with the same code
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command exited with code %d", e.Code)
+}
+
+// hasCommand returns true when the plugin should run a command
+func hasCommand(args Args) bool {
+	return args.Command != "" || len(args.CommandArgs) > 0
+}
+
+// runCommand runs the command with the installation token in its environment
+// as GITHUB_TOKEN and GH_TOKEN. The token is also kept in the file named by
+// GITHUB_TOKEN_FILE, which is refreshed before the token expires so long
+// running commands can pick up a valid token. The tokens of other owners are
+// set as GITHUB_TOKEN_<OWNER> and are not refreshed.
+func runCommand(ctx context.Context, args Args, source *githubapp.InstallationTokenSource, token githubapp.TokenResponse, owners []ownerToken) error {
+	dir, err := os.MkdirTemp("", "drone-github-app-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	if err = writeFileAtomic(tokenFile, []byte(token.Token), 0600); err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	switch {
+	case len(args.CommandArgs) > 0:
+		cmd = exec.Command(args.CommandArgs[0], args.CommandArgs[1:]...)
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("cmd", "/C", args.Command)
+	default:
+		cmd = exec.Command("/bin/sh", "-c", args.Command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(commandEnv(os.Environ(), args.CommandKeepEnv),
+		"GITHUB_TOKEN="+token.Token,
+		"GH_TOKEN="+token.Token,
+		"GITHUB_TOKEN_FILE="+tokenFile,
+	)
+	// each owner token also has a file, refreshed like GITHUB_TOKEN_FILE
+	ownerFiles := make([]string, len(owners))
+	for i, t := range owners {
+		ownerFiles[i] = filepath.Join(dir, fmt.Sprintf("token-%d", i+1))
+		if err = writeFileAtomic(ownerFiles[i], []byte(t.Token.Token), 0600); err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env,
+			ownerTokenVar(t.Owner)+"="+t.Token.Token,
+			ownerTokenVar(t.Owner)+"_FILE="+ownerFiles[i],
+		)
+	}
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("running %s", strings.Join(cmd.Args, " ")))
+
+	// forward signals so the command can shut down cleanly
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done := make(chan struct{})
+	defer close(done)
+	if source != nil {
+		go refreshTokenFile(ctx, "token", source, tokenFile, token.ExpiresAt, done)
+	}
+	for i, t := range owners {
+		if t.Source != nil {
+			go refreshTokenFile(ctx, "token for "+t.Owner, t.Source, ownerFiles[i], t.Token.ExpiresAt, done)
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// refreshTokenFile rewrites the token file with a fresh token shortly before
+// the current token expires, until done is closed. name is used in the log.
+func refreshTokenFile(ctx context.Context, name string, source *githubapp.InstallationTokenSource, path, expiresAt string, done <-chan struct{}) {
+	refreshBefore := source.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = githubapp.DefaultRefreshBefore
+	}
+
+	for {
+		expiry, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			log.Println(fmt.Sprintf("unable to refresh %s: invalid expiry '%s'", name, expiresAt))
+			return
+		}
+
+		wait := time.Until(expiry) - refreshBefore + time.Second
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		response, err := source.InstallationToken()
+		if err != nil {
+			log.Println(fmt.Sprintf("unable to refresh %s: %v", name, err))
+			return
+		}
+		if err = writeFileAtomic(path, []byte(response.Token), 0600); err != nil {
+			log.Println(fmt.Sprintf("unable to write refreshed %s: %v", name, err))
+			return
+		}
+		log.Println(fmt.Sprintf("%s refreshed, expires %s", name, response.ExpiresAt))
+		expiresAt = response.ExpiresAt
+	}
+}
+
+// credentialEnv are variables outside PLUGIN_* the plugin reads credentials
+// from, removed from the command environment unless kept with
+// command_keep_env
+var credentialEnv = []string{
+	"VAULT_TOKEN",
+	"HARNESS_PLATFORM_API_KEY",
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_CONTAINER_AUTHORIZATION_TOKEN",
+	"GOOGLE_APPLICATION_CREDENTIALS",
+}
+
+// commandEnv removes the plugin settings, which include the private key and
+// sink and signer credentials, the credentials the plugin reads from the
+// environment and any existing tokens from the environment passed to the
+// command. Variables named in keep are passed anyway.
+func commandEnv(environ []string, keep []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		switch {
+		case name == "GITHUB_TOKEN" || name == "GH_TOKEN" || name == "GITHUB_TOKEN_FILE" || name == "GITHUB_APP_JWT":
+		case containsFold(keep, name):
+			env = append(env, kv)
+		case strings.HasPrefix(name, "PLUGIN_"):
+		case containsFold(credentialEnv, name):
+		default:
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+// so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
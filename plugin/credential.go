@@ -0,0 +1,281 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// credentialUsername is the username github expects with installation tokens
+const credentialUsername = "x-access-token"
+
+// credentialMinLifetime is the remaining lifetime below which cached
+// credentials are not handed out to git
+const credentialMinLifetime = 5 * time.Minute
+
+// credential is a git credential helper request or response
+type credential struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+	Password string
+	Expiry   time.Time
+}
+
+// GitCredential implements the git credential helper protocol for the given
+// operation (get, store or erase), reading the request from in and writing
+// any credential to out. Installation tokens are cached between invocations
+// in credential_cache_dir until they are close to expiry, encrypted with
+// cache_key when set.
+func GitCredential(ctx context.Context, args Args, operation string, in io.Reader, out io.Writer) error {
+	req, err := readCredential(in)
+	if err != nil {
+		return err
+	}
+
+	apiURL, err := resolveAPIURL(args)
+	if err != nil {
+		return err
+	}
+
+	// only answer for the github instance we are configured for, git will
+	// ask the next helper for anything else
+	if !credentialMatchesAPI(req, apiURL) {
+		return nil
+	}
+
+	owner, repo := credentialRepository(args, req.Path)
+
+	// scope the token to the repository being accessed when no repositories
+	// are configured, limited by least_privilege and the policy like any
+	// other token
+	if repo != "" && args.RepoNames == "" && args.RepoIDs == "" && args.RepoIDsFile == "" {
+		args.RepoNames = repo
+	}
+	opts, err := tokenOptions(args)
+	if err != nil {
+		return err
+	}
+	policies, err := policyFiles(args)
+	if err != nil {
+		return err
+	}
+	if opts, err = applyPolicy(args, policies, opts); err != nil {
+		return err
+	}
+
+	cache, err := credentialCache(args)
+	if err != nil {
+		return err
+	}
+	// the key includes the scope allowed by the policy, so a token cached
+	// under a looser policy is not reused
+	scope, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	cacheKey := strings.Join([]string{req.Host, args.AppId, args.ClientId, args.Installation, owner, repo, string(scope)}, "\n")
+
+	switch operation {
+	case "get":
+		token, err := credentialToken(ctx, args, cache, cacheKey, owner, repo, opts)
+		if err != nil {
+			return err
+		}
+		expiry, _ := time.Parse(time.RFC3339, token.ExpiresAt)
+		return writeCredential(out, credential{
+			Username: credentialUsername,
+			Password: token.Token,
+			Expiry:   expiry,
+		})
+	case "store":
+		// tokens are cached when they are created, only keep what git
+		// confirms worked if it is one of ours
+		if req.Username != credentialUsername || req.Password == "" || req.Expiry.IsZero() {
+			return nil
+		}
+		return cache.put(cacheKey, githubapp.TokenResponse{
+			Token:     req.Password,
+			ExpiresAt: req.Expiry.UTC().Format(time.RFC3339),
+		})
+	case "erase":
+		return cache.remove(cacheKey)
+	default:
+		// unknown operations must be ignored
+		return nil
+	}
+}
+
+// credentialToken returns a cached token for the repository, or creates one
+// when there is no cached token with enough lifetime left
+func credentialToken(ctx context.Context, args Args, cache *tokenCache, cacheKey, owner, repo string, opts githubapp.TokenOptions) (githubapp.TokenResponse, error) {
+	if cached, ok := cache.get(cacheKey); ok {
+		return cached, nil
+	}
+
+	signers, err := newSigners(ctx, args)
+	if err != nil {
+		return githubapp.TokenResponse{}, err
+	}
+
+	issuer := args.AppId
+	if args.ClientId != "" {
+		issuer = args.ClientId
+	}
+
+	github, err := newClient(args)
+	if err != nil {
+		return githubapp.TokenResponse{}, err
+	}
+
+	// with a single key skip checking the key to save a request per git
+	// operation
+	app := githubapp.NewAppTokenSource(issuer, signers[0])
+	appToken, err := app.Token()
+	if len(signers) > 1 {
+		app, appToken, _, err = authenticateApp(ctx, github, issuer, signers)
+	}
+	if err != nil {
+		return githubapp.TokenResponse{}, err
+	}
+
+	var installationID int64
+	if args.Installation != "" {
+		installationID, err = strconv.ParseInt(args.Installation, 10, 64)
+		if err != nil {
+			return githubapp.TokenResponse{}, fmt.Errorf("invalid installation '%s': %v", args.Installation, err)
+		}
+	} else {
+		if owner == "" {
+			return githubapp.TokenResponse{}, errors.New("unable to determine the repository owner: enable credential.useHttpPath or set installation or installation_owner")
+		}
+		installation, err := github.FindInstallation(ctx, appToken.AccessToken, owner, repo)
+		if err != nil {
+			return githubapp.TokenResponse{}, err
+		}
+		installationID = installation.ID
+	}
+
+	token, err := github.CreateInstallationToken(ctx, appToken.AccessToken, installationID, opts)
+	if err != nil {
+		return githubapp.TokenResponse{}, err
+	}
+
+	if err = cache.put(cacheKey, token); err != nil {
+		log.Println(fmt.Sprintf("unable to cache credential: %v", err))
+	}
+	return token, nil
+}
+
+// credentialMatchesAPI returns true if the requested host is the web host of
+// the github api
+func credentialMatchesAPI(req credential, apiURL string) bool {
+	if req.Protocol != "https" && req.Protocol != "http" {
+		return false
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Host)
+	switch {
+	case host == "api.github.com":
+		host = "github.com"
+	case strings.HasPrefix(host, "api.") && strings.HasSuffix(host, ".ghe.com"):
+		host = strings.TrimPrefix(host, "api.")
+	}
+
+	return strings.EqualFold(req.Host, host)
+}
+
+// credentialRepository returns the owner and repository being accessed. The
+// path is only sent by git when credential.useHttpPath is enabled, otherwise
+// the installation owner or drone repository are used.
+func credentialRepository(args Args, path string) (owner, repo string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) >= 2 && parts[0] != "" {
+		return parts[0], strings.TrimSuffix(parts[1], ".git")
+	}
+
+	if args.InstallationOwner != "" || args.InstallationRepo != "" {
+		return installationLookup(args)
+	}
+	return args.Repo.Namespace, ""
+}
+
+// credentialCache returns the cache for tokens created by the helper
+func credentialCache(args Args) (*tokenCache, error) {
+	dir := args.CredentialCacheDir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheDir, "drone-github-app", "credentials")
+	}
+	return newTokenCache(dir, args.CacheKey, credentialMinLifetime), nil
+}
+
+// readCredential reads key=value attributes until a blank line or eof
+func readCredential(in io.Reader) (req credential, err error) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "protocol":
+			req.Protocol = parts[1]
+		case "host":
+			req.Host = parts[1]
+		case "path":
+			req.Path = parts[1]
+		case "username":
+			req.Username = parts[1]
+		case "password":
+			req.Password = parts[1]
+		case "password_expiry_utc":
+			if seconds, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+				req.Expiry = time.Unix(seconds, 0)
+			}
+		}
+	}
+	return req, scanner.Err()
+}
+
+// writeCredential writes a credential helper response
+func writeCredential(out io.Writer, resp credential) error {
+	fmt.Fprintf(out, "username=%s\n", resp.Username)
+	fmt.Fprintf(out, "password=%s\n", resp.Password)
+	if !resp.Expiry.IsZero() {
+		fmt.Fprintf(out, "password_expiry_utc=%d\n", resp.Expiry.Unix())
+	}
+	_, err := fmt.Fprintln(out)
+	return err
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// envVar is a variable written to env files and step outputs
+type envVar struct {
+	Name   string
+	Value  string
+	Secret bool
+}
+
+// envVars returns the variables describing the jwt and installation token
+func envVars(apiURL, installation, jwt string, app githubapp.AppResponse, token githubapp.TokenResponse) []envVar {
+	vars := []envVar{
+		{Name: "GITHUB_API_URL", Value: apiURL},
+		{Name: "GITHUB_APP_ID", Value: strconv.Itoa(app.ID)},
+		{Name: "GITHUB_APP_SLUG", Value: app.Slug},
+	}
+	// there is no jwt with a policy file or the broker
+	if jwt != "" {
+		vars = append(vars, envVar{Name: "GITHUB_APP_JWT", Value: jwt, Secret: true})
+	}
+	if token.Token == "" {
+		return vars
+	}
+
+	var permissions []string
+	for resource, permission := range token.Permissions {
+		permissions = append(permissions, resource+":"+permission)
+	}
+	sort.Strings(permissions)
+
+	var repositories []string
+	for _, repo := range token.Repositories {
+		repositories = append(repositories, repo.Name)
+	}
+
+	return append(vars,
+		envVar{Name: "GITHUB_INSTALLATION_ID", Value: installation},
+		envVar{Name: "GITHUB_TOKEN", Value: token.Token, Secret: true},
+		envVar{Name: "GITHUB_TOKEN_EXPIRES_AT", Value: token.ExpiresAt},
+		envVar{Name: "GITHUB_TOKEN_PERMISSIONS", Value: strings.Join(permissions, ",")},
+		envVar{Name: "GITHUB_TOKEN_REPOSITORY_SELECTION", Value: token.RepositorySelection},
+		envVar{Name: "GITHUB_TOKEN_REPOSITORIES", Value: strings.Join(repositories, ",")},
+	)
+}
+
+// formatEnv formats variables as a dotenv file, or as shell exports that
+// can be sourced
+func formatEnv(vars []envVar, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		switch format {
+		case "", "dotenv":
+			fmt.Fprintf(&buf, "%s=%s\n", v.Name, dotenvQuote(v.Value))
+		case "export":
+			fmt.Fprintf(&buf, "export %s=%s\n", v.Name, shellQuote(v.Value))
+		default:
+			return nil, fmt.Errorf("unknown env_format '%s': expected dotenv or export", format)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeEnvFile writes the variables to the env file
+func writeEnvFile(path, format string, vars []envVar) error {
+	data, err := formatEnv(vars, format)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// writeOutputVariables appends the variables to the step output files. The
+// runner provides DRONE_OUTPUT for output variables, and harness provides
+// HARNESS_OUTPUT_SECRET_FILE for outputs that are masked as secrets. Without
+// a secret file the secret variables are skipped, as plain outputs are not
+// masked, unless plainSecrets is set.
+func writeOutputVariables(outputFile, secretFile string, plainSecrets bool, vars []envVar) error {
+	var plain, secret []envVar
+	var skipped []string
+	for _, v := range vars {
+		switch {
+		case v.Secret && secretFile != "":
+			secret = append(secret, v)
+		case v.Secret && !plainSecrets:
+			skipped = append(skipped, v.Name)
+		default:
+			plain = append(plain, v)
+		}
+	}
+	if len(skipped) > 0 {
+		log.Println(fmt.Sprintf("not writing %s as step outputs: the runner provides no secret output file, so they would not be masked. set output_plain_secrets to write them anyway", strings.Join(skipped, ", ")))
+	}
+
+	if err := appendEnvFile(outputFile, plain); err != nil {
+		return err
+	}
+	return appendEnvFile(secretFile, secret)
+}
+
+// appendEnvFile appends dotenv variables to a file shared with other steps
+func appendEnvFile(path string, vars []envVar) error {
+	if len(vars) == 0 {
+		return nil
+	}
+
+	data, err := formatEnv(vars, "dotenv")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// dotenvQuote double quotes values that contain characters dotenv parsers
+// treat specially
+func dotenvQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\"'#$\\=`") {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "$", `\$`, "`", "\\`")
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// shellQuote single quotes a value for posix shells
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// validateBrokerArgs checks the settings used with broker_url
+func validateBrokerArgs(args Args) error {
+	if args.BrokerToken == "" && args.OIDCToken == "" && args.OIDCTokenFile == "" {
+		return errors.New("broker_token, oidc_token or oidc_token_file must be set with broker_url")
+	}
+	if args.JwtFile != "" || args.JwtSecret != "" {
+		return errors.New("jwt_file and jwt_secret cannot be used with broker_url: the broker keeps the app private key")
+	}
+	return nil
+}
+
+// brokerExec creates the token at the broker and writes it to the outputs
+func brokerExec(ctx context.Context, args Args, opts githubapp.TokenOptions, outputs []output) error {
+	// the broker mints tokens for one installation
+	if hasRepositoryOwners(opts.Repositories) {
+		return errors.New("repo_names cannot include owners with broker_url - use one step per owner")
+	}
+
+	req := tokenRequest{}
+	var err error
+	if args.Installation != "" {
+		req.Installation, err = strconv.ParseInt(args.Installation, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid installation '%s': %v", args.Installation, err)
+		}
+	} else {
+		req.Owner, req.Repo = installationLookup(args)
+	}
+	req.Repositories = opts.Repositories
+	req.RepositoryIDs = opts.RepositoryIDs
+	req.Permissions = opts.Permissions
+
+	token, app, installation, err := exchangeToken(ctx, args, req)
+	if err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("token received from broker for installation %s, expires %s", installation, token.ExpiresAt))
+
+	apiURL, err := resolveAPIURL(args)
+	if err != nil {
+		return err
+	}
+	data := outputData{
+		APIURL:       apiURL,
+		App:          app,
+		Installation: installation,
+		Token:        token,
+	}
+
+	var written []string
+	for _, o := range outputs {
+		w, err := o.Write(ctx, data)
+		if err != nil {
+			return err
+		}
+		written = append(written, w...)
+	}
+
+	if hasCommand(args) {
+		written = append(written, "command environment")
+	}
+
+	if args.Card.Path != "" {
+		id, _ := strconv.ParseInt(installation, 10, 64)
+		writeCard(args.Card.Path, cardSchema, newCard(app, githubapp.InstallationResponse{ID: id}, token, false, written))
+	}
+
+	if hasCommand(args) {
+		// the broker token is not refreshed, the command has the token
+		// lifetime to finish
+		return runCommand(ctx, args, nil, token, nil)
+	}
+	return nil
+}
+
+// exchangeToken requests a token from the broker, with the oidc token when
+// set and the broker token otherwise
+func exchangeToken(ctx context.Context, args Args, req tokenRequest) (token githubapp.TokenResponse, app githubapp.AppResponse, installation string, err error) {
+	path, credential := "/token", args.BrokerToken
+	if args.OIDCToken != "" || args.OIDCTokenFile != "" {
+		path, credential = "/oidc/token", args.OIDCToken
+		if args.OIDCTokenFile != "" {
+			data, err := os.ReadFile(args.OIDCTokenFile)
+			if err != nil {
+				return token, app, "", fmt.Errorf("unable to read oidc_token_file: %v", err)
+			}
+			credential = strings.TrimSpace(string(data))
+		}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return token, app, "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(args.BrokerURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return token, app, "", err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+credential)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := githubapp.NewRetryClient(args.HTTPTimeout, args.HTTPRetries).Do(httpReq)
+	if err != nil {
+		return token, app, "", fmt.Errorf("unable to reach the broker: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		failure := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return token, app, "", fmt.Errorf("broker returned %d: %s", resp.StatusCode, firstNonEmpty(failure.Message, http.StatusText(resp.StatusCode)))
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return token, app, "", fmt.Errorf("unable to decode the broker response: %v", err)
+	}
+
+	app.ID, _ = strconv.Atoi(resp.Header.Get("X-GitHub-App-Id"))
+	app.Slug = resp.Header.Get("X-GitHub-App-Slug")
+	return token, app, resp.Header.Get("X-GitHub-App-Installation-Id"), nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/antihax/optional"
+	"github.com/harness/harness-go-sdk/harness/nextgen"
+)
+
+// harnessDefaultSecretManager is the built in harness secret manager
+const harnessDefaultSecretManager = "harnessSecretManager"
+
+// harnessSink stores secrets as harness text secrets
+type harnessSink struct {
+	client        *nextgen.APIClient
+	apiKey        string
+	accountID     string
+	org           string
+	project       string
+	secretManager string
+	name          string
+	description   string
+	tags          map[string]string
+	writeMode     string
+}
+
+// newHarnessSink returns a sink for the configured account and scope. The
+// api key, account, org and project default to the HARNESS_* variables used
+// by the harness terraform provider and sdk.
+func newHarnessSink(args Args) (*harnessSink, error) {
+	s := &harnessSink{
+		apiKey:        firstNonEmpty(args.HarnessAPIKey, os.Getenv("HARNESS_PLATFORM_API_KEY")),
+		accountID:     firstNonEmpty(args.HarnessAccountID, os.Getenv("HARNESS_ACCOUNT_ID")),
+		secretManager: firstNonEmpty(args.SecretManager, harnessDefaultSecretManager),
+		name:          args.SecretName,
+		description:   args.SecretDescription,
+		writeMode:     args.SecretWriteMode,
+	}
+	if s.apiKey == "" {
+		return nil, errors.New("harness_api_key or HARNESS_PLATFORM_API_KEY must be set to write harness secrets")
+	}
+	if s.accountID == "" {
+		return nil, errors.New("harness_account_id or HARNESS_ACCOUNT_ID must be set to write harness secrets")
+	}
+
+	var err error
+	s.tags, err = parseKeyValues(args.SecretTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret_tags: %v", err)
+	}
+
+	switch s.writeMode {
+	case "", "upsert", "create", "update":
+	default:
+		return nil, fmt.Errorf("unknown secret_write_mode '%s': expected upsert, create or update", s.writeMode)
+	}
+
+	// without an explicit scope keep the scope from the environment, when a
+	// scope is asked for fall back to the org and project of the pipeline
+	org := firstNonEmpty(args.HarnessOrg, os.Getenv("HARNESS_PLATFORM_ORGANIZATION"))
+	project := firstNonEmpty(args.HarnessProject, os.Getenv("HARNESS_PLATFORM_PROJECT"))
+	switch args.SecretScope {
+	case "":
+		s.org, s.project = org, project
+	case "account":
+	case "org":
+		s.org = firstNonEmpty(org, os.Getenv("HARNESS_ORG_ID"))
+		if s.org == "" {
+			return nil, errors.New("harness_org must be set for org scoped secrets")
+		}
+	case "project":
+		s.org = firstNonEmpty(org, os.Getenv("HARNESS_ORG_ID"))
+		s.project = firstNonEmpty(project, os.Getenv("HARNESS_PROJECT_ID"))
+		if s.org == "" || s.project == "" {
+			return nil, errors.New("harness_org and harness_project must be set for project scoped secrets")
+		}
+	default:
+		return nil, fmt.Errorf("unknown secret_scope '%s': expected account, org or project", args.SecretScope)
+	}
+	if s.project != "" && s.org == "" {
+		return nil, errors.New("harness_org must be set with harness_project")
+	}
+
+	cfg := nextgen.NewConfiguration()
+	cfg.ApiKey = s.apiKey
+	cfg.AccountId = s.accountID
+	if endpoint := firstNonEmpty(args.HarnessEndpoint, os.Getenv("HARNESS_ENDPOINT")); endpoint != "" {
+		cfg.BasePath = strings.TrimRight(endpoint, "/")
+	}
+	cfg.HTTPClient.RetryMax = args.HTTPRetries
+	cfg.HTTPClient.HTTPClient.Timeout = args.HTTPTimeout
+	s.client = nextgen.NewAPIClient(cfg)
+
+	return s, nil
+}
+
+func (s *harnessSink) Name() string {
+	return "harness"
+}
+
+// scope returns the scope of the secret, for logs
+func (s *harnessSink) scope() string {
+	switch {
+	case s.project != "":
+		return fmt.Sprintf("project %s/%s", s.org, s.project)
+	case s.org != "":
+		return fmt.Sprintf("org %s", s.org)
+	default:
+		return "account"
+	}
+}
+
+// Store creates or updates the text secret according to secret_write_mode
+func (s *harnessSink) Store(ctx context.Context, secret Secret) error {
+	hCtx := context.WithValue(ctx, nextgen.ContextAPIKey, nextgen.APIKey{Key: s.apiKey})
+	org, project := optional.EmptyString(), optional.EmptyString()
+	if s.org != "" {
+		org = optional.NewString(s.org)
+	}
+	if s.project != "" {
+		project = optional.NewString(s.project)
+	}
+
+	body := nextgen.SecretRequestWrapper{Secret: &nextgen.Secret{
+		Type_:             nextgen.SecretTypes.SecretText,
+		Name:              firstNonEmpty(s.name, secret.ID),
+		Identifier:        secret.ID,
+		OrgIdentifier:     s.org,
+		ProjectIdentifier: s.project,
+		Tags:              s.tags,
+		Description:       firstNonEmpty(s.description, harnessDescription(secret)),
+		Text: &nextgen.SecretTextSpec{
+			Type_:                   nextgen.SecretSpecTypes.Text,
+			ValueType:               nextgen.SecretTextValueTypes.Inline,
+			Value:                   secret.Value,
+			SecretManagerIdentifier: s.secretManager,
+		},
+	}}
+
+	exists := false
+	if s.writeMode != "create" {
+		_, resp, err := s.client.SecretsApi.GetSecretV2(hCtx, secret.ID, s.accountID, &nextgen.SecretsApiGetSecretV2Opts{
+			OrgIdentifier:     org,
+			ProjectIdentifier: project,
+		})
+		switch {
+		case err == nil:
+			exists = true
+		case !harnessNotFound(resp, err):
+			return fmt.Errorf("unable to get harness secret %s in %s: %v", secret.ID, s.scope(), err)
+		}
+	}
+
+	switch {
+	case exists:
+		_, _, err := s.client.SecretsApi.PutSecret(hCtx, s.accountID, secret.ID, &nextgen.SecretsApiPutSecretOpts{
+			Body:              optional.NewInterface(body),
+			OrgIdentifier:     org,
+			ProjectIdentifier: project,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to update harness secret %s in %s: %v", secret.ID, s.scope(), err)
+		}
+	case s.writeMode == "update":
+		return fmt.Errorf("harness secret %s does not exist in %s and secret_write_mode is update", secret.ID, s.scope())
+	default:
+		_, _, err := s.client.SecretsApi.PostSecret(hCtx, body, s.accountID, &nextgen.SecretsApiPostSecretOpts{
+			OrgIdentifier:     org,
+			ProjectIdentifier: project,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create harness secret %s in %s: %v", secret.ID, s.scope(), err)
+		}
+	}
+	return nil
+}
+
+// harnessDescription describes where the secret came from and when it
+// expires
+func harnessDescription(secret Secret) string {
+	description := fmt.Sprintf("github app %s", secret.Kind)
+	if secret.App != "" {
+		description = fmt.Sprintf("github app %s %s", secret.App, secret.Kind)
+	}
+	if secret.Installation != "" && secret.Kind != "jwt" {
+		description += fmt.Sprintf(" for installation %s", secret.Installation)
+	}
+	if !secret.ExpiresAt.IsZero() {
+		description += fmt.Sprintf(", expires %s", secret.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return description
+}
+
+// harnessNotFound returns true if the harness api returned that the secret
+// does not exist
+func harnessNotFound(resp *http.Response, err error) bool {
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return true
+	}
+	var swaggerErr nextgen.GenericSwaggerError
+	if errors.As(err, &swaggerErr) {
+		if failure, ok := swaggerErr.Model().(nextgen.Failure); ok {
+			return failure.Code == string(nextgen.ErrorCodes.ResourceNotFound)
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// maxPBKDF2Iterations limits the work a crafted key file can demand, openssl
+// defaults to 2048 iterations
+const maxPBKDF2Iterations = 10000000
+
+// encryptedPrivateKeyInfo is an encrypted pkcs#8 private key (rfc 5208)
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params are the parameters of pbes2 encryption (rfc 8018)
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the parameters of pbkdf2 key derivation (rfc 8018)
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// parsePrivateKey parses an rsa private key in pkcs#1 (RSA PRIVATE KEY) or
+// pkcs#8 (PRIVATE KEY) pem format. Keys encrypted with the legacy openssl
+// pem encryption or pkcs#8 pbes2 are decrypted with passphrase.
+func parsePrivateKey(data, passphrase []byte) (*rsa.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found in pem: expected a BEGIN RSA PRIVATE KEY or BEGIN PRIVATE KEY block")
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			der := block.Bytes
+			// legacy pem encryption is deprecated but still written by
+			// openssl rsa -aes256 and ssh-keygen
+			if x509.IsEncryptedPEMBlock(block) {
+				if len(passphrase) == 0 {
+					return nil, errors.New("private key is encrypted: set pem_passphrase or pem_passphrase_file")
+				}
+				var err error
+				der, err = x509.DecryptPEMBlock(block, passphrase)
+				if err != nil {
+					return nil, fmt.Errorf("unable to decrypt private key: %v", err)
+				}
+			}
+			key, err := x509.ParsePKCS1PrivateKey(der)
+			if err != nil {
+				// some tools label pkcs#8 keys as RSA PRIVATE KEY
+				if _, pkcs8Err := x509.ParsePKCS8PrivateKey(der); pkcs8Err == nil {
+					return parsePKCS8PrivateKey(der)
+				}
+				return nil, fmt.Errorf("unable to parse pkcs#1 private key: %v", err)
+			}
+			return key, nil
+		case "PRIVATE KEY":
+			return parsePKCS8PrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			if len(passphrase) == 0 {
+				return nil, errors.New("private key is encrypted: set pem_passphrase or pem_passphrase_file")
+			}
+			der, err := decryptPKCS8(block.Bytes, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			return parsePKCS8PrivateKey(der)
+		case "EC PRIVATE KEY":
+			return nil, errors.New("private key is an ecdsa key: github apps use rsa keys, download a private key from the app settings")
+		case "OPENSSH PRIVATE KEY":
+			return nil, errors.New("private key is in openssh format: use the pem file downloaded from the app settings, or convert it with ssh-keygen -p -m PEM")
+		case "PUBLIC KEY", "RSA PUBLIC KEY", "CERTIFICATE":
+			return nil, fmt.Errorf("pem contains a %s, not a private key: use the private key downloaded from the app settings", block.Type)
+		}
+		// skip any other blocks, e.g. parameters written before the key
+	}
+}
+
+// parsePKCS8PrivateKey parses a pkcs#8 key, which must be an rsa key
+func parsePKCS8PrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pkcs#8 private key: %v", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return nil, errors.New("private key is an ecdsa key: github apps use rsa keys, download a private key from the app settings")
+	case ed25519.PrivateKey:
+		return nil, errors.New("private key is an ed25519 key: github apps use rsa keys, download a private key from the app settings")
+	default:
+		return nil, fmt.Errorf("private key is a %T: github apps use rsa keys", key)
+	}
+}
+
+// decryptPKCS8 decrypts a pbes2 encrypted pkcs#8 key with pbkdf2 key
+// derivation and aes or 3des cbc encryption
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("unable to parse encrypted private key: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported private key encryption %v: only pbes2 is supported, re-encrypt the key with openssl pkcs8 -topk8 -v2 aes-256-cbc", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("unable to parse pbes2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v: only pbkdf2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("unable to parse pbkdf2 parameters: %v", err)
+	}
+	if kdf.IterationCount < 1 || kdf.IterationCount > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("invalid pbkdf2 iteration count %d: must be between 1 and %d", kdf.IterationCount, maxPBKDF2Iterations)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported pbkdf2 prf %v", kdf.PRF.Algorithm)
+	}
+
+	var keyLen int
+	var newCipher func(key []byte) (cipher.Block, error)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported private key cipher %v: use aes-256-cbc", scheme)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("unable to parse cipher parameters: %v", err)
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdf.Salt, kdf.IterationCount, keyLen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive private key encryption key: %v", err)
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// remove the pkcs#7 padding, a wrong passphrase almost always leaves
+	// invalid padding
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("unable to decrypt private key: incorrect passphrase")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("unable to decrypt private key: incorrect passphrase")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// errNoKeySource is returned when no private key source is set
+var errNoKeySource = errors.New("one of pem, pem_file, pem_b64, pem_vault, pem_kubernetes, pem_command, pem_files or pems_b64 must be set")
+
+// splitRef splits a path#field reference, returning def when there is no
+// field
+func splitRef(ref, def string) (path, field string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, def
+}
+
+// decodeKey returns data as is when it is a pem, and base64 decodes it
+// otherwise, so keys can be stored either way
+func decodeKey(data []byte) []byte {
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		return data
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		return decoded
+	}
+	return data
+}
+
+// readVaultKey reads the private key from the vault kv path#field in
+// pem_vault, using the vault settings of the vault sink
+func readVaultKey(ctx context.Context, args Args) ([]byte, error) {
+	path, field := splitRef(strings.Trim(args.PemVault, "/"), args.VaultField)
+
+	client, err := newVaultClient(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	mount := strings.Trim(args.VaultMount, "/")
+	kvPath := fmt.Sprintf("%s/%s", mount, path)
+	if args.VaultKVVersion == 2 {
+		kvPath = fmt.Sprintf("%s/data/%s", mount, path)
+	}
+
+	resp, err := client.request(ctx, "GET", kvPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read pem_vault: %v", err)
+	}
+
+	var data map[string]interface{}
+	if args.VaultKVVersion == 2 {
+		kv := struct {
+			Data map[string]interface{} `json:"data"`
+		}{}
+		err = json.Unmarshal(resp.Data, &kv)
+		data = kv.Data
+	} else {
+		err = json.Unmarshal(resp.Data, &data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode pem_vault: %v", err)
+	}
+
+	value, ok := data[field].(string)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("pem_vault secret %s has no field '%s'", path, field)
+	}
+	return decodeKey([]byte(value)), nil
+}
+
+// readKubernetesKey reads the private key from the kubernetes secret
+// [namespace/]name#key in pem_kubernetes
+func readKubernetesKey(ctx context.Context, args Args) ([]byte, error) {
+	ref, key := splitRef(args.PemKubernetes, "pem")
+
+	client, err := newKubeClient(args)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace, name := client.namespace, ref
+	if i := strings.Index(ref, "/"); i >= 0 {
+		namespace, name = ref[:i], ref[i+1:]
+	}
+
+	secret := kubeSecret{}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if _, err = client.request(ctx, "GET", path, "", nil, &secret); err != nil {
+		return nil, fmt.Errorf("unable to read pem_kubernetes: %v", err)
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("pem_kubernetes secret %s/%s has no key '%s'", namespace, name, key)
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode pem_kubernetes: %v", err)
+	}
+	return decodeKey(data), nil
+}
+
+// runKeyCommand runs pem_command, reading the private key from its stdout
+func runKeyCommand(ctx context.Context, args Args) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", args.PemCommand)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", args.PemCommand)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pem_command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("pem_command did not print a private key")
+	}
+	return decodeKey(stdout.Bytes()), nil
+}
+
+// readKeySource reads the private key from the first configured source
+func readKeySource(ctx context.Context, args Args) ([]byte, error) {
+	switch {
+	case args.Pem != "":
+		return []byte(args.Pem), nil
+	case args.PemFile != "":
+		data, err := os.ReadFile(args.PemFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pem_file: %v", err)
+		}
+		return data, nil
+	case args.PemB64 != "":
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(args.PemB64))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode pem_b64: %v", err)
+		}
+		return data, nil
+	case args.PemVault != "":
+		return readVaultKey(ctx, args)
+	case args.PemKubernetes != "":
+		return readKubernetesKey(ctx, args)
+	case args.PemCommand != "":
+		return runKeyCommand(ctx, args)
+	default:
+		return nil, errNoKeySource
+	}
+}
+
+// splitPrivateKeys splits concatenated pems into one pem per private key.
+// Data without private key blocks is returned as is so parsing it explains
+// what is wrong.
+func splitPrivateKeys(data []byte) [][]byte {
+	var keys [][]byte
+	var prefix []byte
+	for rest := data; ; {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		// keep blocks written before a key, e.g. parameters, with the key
+		prefix = append(prefix, rest[:len(rest)-len(next)]...)
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			keys = append(keys, prefix)
+			prefix = nil
+		}
+		rest = next
+	}
+	if len(keys) < 2 {
+		return [][]byte{data}
+	}
+	return keys
+}
@@ -0,0 +1,359 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// kubeManagedBy is the managed-by label set on secrets written by the plugin
+const kubeManagedBy = "drone-github-app"
+
+// kubeSecret is a kubernetes v1 Secret
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string            `json:"kind" yaml:"kind"`
+	Metadata   kubeMetadata      `json:"metadata" yaml:"metadata"`
+	Type       string            `json:"type,omitempty" yaml:"type,omitempty"`
+	Data       map[string]string `json:"data" yaml:"data"`
+}
+
+// kubeMetadata is the object metadata of a secret
+type kubeMetadata struct {
+	Name        string            `json:"name" yaml:"name"`
+	Namespace   string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// kubeDockerConfigJSON and kubeBasicAuth are the secret types that hold the
+// token in a standard format
+const (
+	kubeDockerConfigJSON = "kubernetes.io/dockerconfigjson"
+	kubeBasicAuth        = "kubernetes.io/basic-auth"
+)
+
+// kubeClient makes requests against the kubernetes api
+type kubeClient struct {
+	server    string
+	namespace string
+	client    *http.Client
+}
+
+// newKubeClient returns a client for the configured kubeconfig, or the in
+// cluster service account when there is no kubeconfig and the plugin runs in
+// a pod. Authentication, including exec credential plugins, is left to
+// client-go.
+func newKubeClient(args Args) (*kubeClient, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = args.Kubeconfig
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{
+		CurrentContext: args.KubeContext,
+		Context:        clientcmdapi.Context{Namespace: args.KubeNamespace},
+	})
+
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load kubeconfig: %v", err)
+	}
+	namespace, _, err := loader.Namespace()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the kubernetes namespace: %v", err)
+	}
+
+	config.Timeout = args.HTTPTimeout
+	client, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create kubernetes client: %v", err)
+	}
+
+	return &kubeClient{
+		server:    strings.TrimRight(config.Host, "/"),
+		namespace: firstNonEmpty(namespace, "default"),
+		client:    client,
+	}, nil
+}
+
+// request makes a request to the kubernetes api, decoding the response into
+// out when set
+func (c *kubeClient) request(ctx context.Context, method, path, contentType string, body, out interface{}) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		json.Unmarshal(data, &status)
+		if status.Message != "" {
+			return resp.StatusCode, fmt.Errorf("kubernetes returned %s for %s: %s", resp.Status, path, status.Message)
+		}
+		return resp.StatusCode, fmt.Errorf("kubernetes returned %s for %s", resp.Status, path)
+	}
+
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
+
+// kubernetesSink stores secrets as keys of kubernetes secrets, the secret id
+// is the name of the kubernetes secret. Outputs with the same id are written
+// to the same secret under their own key.
+type kubernetesSink struct {
+	client      *kubeClient
+	namespace   string
+	keys        map[string]string
+	labels      map[string]string
+	annotations map[string]string
+
+	// secretType is Opaque, or a type holding the token in a standard format
+	// for registry or git credentials
+	secretType string
+	registry   string
+	username   string
+
+	// manifest mode writes the secrets to manifestFile instead of applying
+	// them, so they have to be kept to write all of them each time
+	manifestFile string
+	manifest     []*kubeSecret
+}
+
+// newKubernetesSink returns a sink writing to the cluster, or to the
+// manifest file when kube_manifest_file is set
+func newKubernetesSink(args Args) (*kubernetesSink, error) {
+	labels, err := parseKeyValues(args.KubeLabels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kube_labels: %v", err)
+	}
+	annotations, err := parseKeyValues(args.KubeAnnotations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kube_annotations: %v", err)
+	}
+	labels["app.kubernetes.io/managed-by"] = kubeManagedBy
+
+	secretType := firstNonEmpty(args.KubeSecretType, "Opaque")
+	switch secretType {
+	case "Opaque":
+	case kubeDockerConfigJSON, kubeBasicAuth:
+		if args.JwtSecret != "" || args.JsonSecret != "" {
+			return nil, fmt.Errorf("kube_secret_type %s only holds the token, use token_secret without jwt_secret and json_secret", secretType)
+		}
+	default:
+		return nil, fmt.Errorf("unknown kube_secret_type '%s': expected Opaque, %s or %s", secretType, kubeDockerConfigJSON, kubeBasicAuth)
+	}
+
+	sink := &kubernetesSink{
+		namespace: args.KubeNamespace,
+		keys: map[string]string{
+			"jwt":   args.KubeJwtKey,
+			"token": args.KubeTokenKey,
+			"json":  args.KubeJsonKey,
+		},
+		labels:       labels,
+		annotations:  annotations,
+		secretType:   secretType,
+		registry:     firstNonEmpty(args.KubeRegistry, "ghcr.io"),
+		username:     firstNonEmpty(args.KubeUsername, "x-access-token"),
+		manifestFile: args.KubeManifestFile,
+	}
+	if sink.manifestFile != "" {
+		return sink, nil
+	}
+
+	sink.client, err = newKubeClient(args)
+	if err != nil {
+		return nil, err
+	}
+	sink.namespace = sink.client.namespace
+	return sink, nil
+}
+
+func (s *kubernetesSink) Name() string {
+	if s.manifestFile != "" {
+		return "kubernetes manifest"
+	}
+	return "kubernetes"
+}
+
+// Store sets the key for the secret kind in the named secret, creating the
+// secret when it does not exist. The expiry is set as an annotation.
+func (s *kubernetesSink) Store(ctx context.Context, secret Secret) error {
+	data, err := s.secretData(secret)
+	if err != nil {
+		return err
+	}
+
+	annotations := map[string]string{}
+	for k, v := range s.annotations {
+		annotations[k] = v
+	}
+	if !secret.ExpiresAt.IsZero() {
+		annotations[fmt.Sprintf("%s/%s-expires-at", kubeManagedBy, secret.Kind)] = secret.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	object := &kubeSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: kubeMetadata{
+			Name:        secret.ID,
+			Namespace:   s.namespace,
+			Labels:      s.labels,
+			Annotations: annotations,
+		},
+		Type: s.secretType,
+		Data: data,
+	}
+
+	if s.manifestFile != "" {
+		return s.writeManifest(object)
+	}
+
+	path := fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(s.namespace), url.PathEscape(secret.ID))
+	// a merge patch keeps keys written by earlier outputs or other tools
+	status, err := s.client.request(ctx, "PATCH", path, "application/merge-patch+json", map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      object.Metadata.Labels,
+			"annotations": object.Metadata.Annotations,
+		},
+		// the type cannot be changed, so a mismatch fails instead of writing
+		// keys the secret type does not expect
+		"type": object.Type,
+		"data": object.Data,
+	}, nil)
+	if status != http.StatusNotFound {
+		return err
+	}
+
+	_, err = s.client.request(ctx, "POST", fmt.Sprintf("/api/v1/namespaces/%s/secrets", url.PathEscape(s.namespace)), "application/json", object, nil)
+	return err
+}
+
+// secretData returns the secret keys for the output, base64 encoded
+func (s *kubernetesSink) secretData(secret Secret) (map[string]string, error) {
+	encode := func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+
+	if s.secretType != "Opaque" && secret.Kind != "token" {
+		return nil, fmt.Errorf("kube_secret_type %s only holds the token, not the %s", s.secretType, secret.Kind)
+	}
+
+	switch s.secretType {
+	case kubeDockerConfigJSON:
+		config, err := json.Marshal(map[string]interface{}{
+			"auths": map[string]interface{}{
+				s.registry: map[string]string{
+					"username": s.username,
+					"password": secret.Value,
+					"auth":     encode(s.username + ":" + secret.Value),
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{".dockerconfigjson": encode(string(config))}, nil
+	case kubeBasicAuth:
+		return map[string]string{"username": encode(s.username), "password": encode(secret.Value)}, nil
+	}
+
+	key := s.keys[secret.Kind]
+	if key == "" {
+		key = secret.Kind
+	}
+	return map[string]string{key: encode(secret.Value)}, nil
+}
+
+// writeManifest merges object into the secrets written so far and writes
+// them all to the manifest file
+func (s *kubernetesSink) writeManifest(object *kubeSecret) error {
+	merged := false
+	for _, existing := range s.manifest {
+		if existing.Metadata.Name != object.Metadata.Name {
+			continue
+		}
+		for k, v := range object.Metadata.Annotations {
+			existing.Metadata.Annotations[k] = v
+		}
+		for k, v := range object.Data {
+			existing.Data[k] = v
+		}
+		merged = true
+	}
+	if !merged {
+		s.manifest = append(s.manifest, object)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	for _, secret := range s.manifest {
+		if err := encoder.Encode(secret); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.manifestFile, buf.Bytes(), 0600)
+}
+
+// parseKeyValues parses comma separated key=value pairs
+func parseKeyValues(value string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("'%s' is not in key=value format", pair)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return values, nil
+}
@@ -0,0 +1,421 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// jwksRefreshAfter is how long the issuer keys are used before fetching
+	// them again
+	jwksRefreshAfter = 15 * time.Minute
+
+	// jwksCacheTTL is how long the issuer keys are still used when fetching
+	// them again fails
+	jwksCacheTTL = time.Hour
+
+	// jwksMinRefresh limits fetching the keys again for unknown key ids and
+	// after a failed fetch
+	jwksMinRefresh = time.Minute
+)
+
+// oidcSigningMethods are the id token algorithms accepted
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384"}
+
+// jsonWebKey is a public key in a jwks (rfc 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcVerifier verifies id tokens of one issuer
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	jwksFile string
+	client   *http.Client
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	fetched    time.Time
+	attempted  time.Time
+	err        error         // the error of the last fetch
+	refreshing chan struct{} // closed when the running fetch is done
+}
+
+// newOIDCVerifier returns a verifier for the issuer. The keys are read from
+// oidc_jwks_file, oidc_jwks_url or the issuer's discovery document.
+func newOIDCVerifier(args Args) (*oidcVerifier, error) {
+	if args.OIDCIssuer == "" || args.OIDCAudience == "" {
+		return nil, errors.New("oidc_issuer and oidc_audience must be set to exchange oidc tokens")
+	}
+	return &oidcVerifier{
+		issuer:   strings.TrimRight(args.OIDCIssuer, "/"),
+		audience: args.OIDCAudience,
+		jwksURL:  args.OIDCJWKSURL,
+		jwksFile: args.OIDCJWKSFile,
+		client:   &http.Client{Timeout: args.HTTPTimeout},
+	}, nil
+}
+
+// Verify checks the signature, issuer, audience and lifetime of the id
+// token, returning its claims
+func (v *oidcVerifier) Verify(ctx context.Context, raw string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(oidcSigningMethods))
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid oidc token: %v", err)
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("invalid oidc token: no expiry")
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != v.issuer {
+		return nil, fmt.Errorf("invalid oidc token: issuer '%s' is not %s", iss, v.issuer)
+	}
+	if !claims.VerifyAudience(v.audience, true) {
+		return nil, fmt.Errorf("invalid oidc token: audience is not %s", v.audience)
+	}
+	return claims, nil
+}
+
+// key returns the issuer key with the key id, fetching the keys when they
+// are old or the key id is unknown, e.g. after the issuer rotated its keys.
+// Only one request fetches the keys, without holding the lock, and the
+// cached keys are used until they expire when the fetch fails.
+func (v *oidcVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	for {
+		v.mu.Lock()
+		key, ok := v.lookup(kid)
+		cached := ok && time.Since(v.fetched) < jwksCacheTTL
+		if cached && (time.Since(v.fetched) < jwksRefreshAfter || v.refreshing != nil) {
+			v.mu.Unlock()
+			return key, nil
+		}
+
+		// wait for the request that is fetching the keys
+		if done := v.refreshing; done != nil {
+			v.mu.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if time.Since(v.attempted) < jwksMinRefresh {
+			err := v.err
+			v.mu.Unlock()
+			if cached {
+				return key, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("no key '%s' in the issuer jwks", kid)
+			}
+			return nil, err
+		}
+
+		done := make(chan struct{})
+		v.refreshing, v.attempted = done, time.Now()
+		v.mu.Unlock()
+
+		// the fetch is shared with the waiting requests so it does not end
+		// when this request is cancelled
+		keys, err := v.fetch(context.WithoutCancel(ctx))
+
+		v.mu.Lock()
+		if err == nil {
+			v.keys, v.fetched = keys, time.Now()
+		} else if cached {
+			log.Println(fmt.Sprintf("unable to fetch the oidc issuer keys, using the cached keys: %v", err))
+		}
+		v.err = err
+		v.refreshing = nil
+		close(done)
+		v.mu.Unlock()
+	}
+}
+
+// lookup returns the key with the key id, or the only key when the token
+// has no key id
+func (v *oidcVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// fetch reads the issuer jwks
+func (v *oidcVerifier) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if v.jwksFile != "" {
+		data, err = os.ReadFile(v.jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read oidc_jwks_file: %v", err)
+		}
+	} else {
+		jwksURL := v.jwksURL
+		if jwksURL == "" {
+			discovery := struct {
+				JWKSURI string `json:"jwks_uri"`
+			}{}
+			if err = v.get(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+				return nil, err
+			}
+			if discovery.JWKSURI == "" {
+				return nil, fmt.Errorf("oidc issuer %s has no jwks_uri", v.issuer)
+			}
+			jwksURL = discovery.JWKSURI
+		}
+		raw := json.RawMessage{}
+		if err = v.get(ctx, jwksURL, &raw); err != nil {
+			return nil, err
+		}
+		data = raw
+	}
+	return parseJWKS(data)
+}
+
+// get reads json from the issuer
+func (v *oidcVerifier) get(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %s: %s", url, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unable to decode %s: %v", url, err)
+	}
+	return nil
+}
+
+// parseJWKS returns the rsa and ecdsa signing keys of a jwks by key id
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("unable to parse jwks: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				return nil, fmt.Errorf("invalid rsa key '%s' in jwks", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid ec key '%s' in jwks", jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks has no rsa or ec signing keys")
+	}
+	return keys, nil
+}
+
+// globs is one glob, or a list of globs, a value must match
+type globs []string
+
+func (g *globs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*g = globs{node.Value}
+		return nil
+	}
+	var patterns []string
+	if err := node.Decode(&patterns); err != nil {
+		return err
+	}
+	*g = patterns
+	return nil
+}
+
+// validate checks the globs are valid patterns
+func (g globs) validate() error {
+	for _, pattern := range g {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s'", pattern)
+		}
+	}
+	return nil
+}
+
+// match returns true if value matches one of the globs
+func (g globs) match(value string) bool {
+	for _, pattern := range g {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcRule grants tokens to id tokens with matching claims
+type oidcRule struct {
+	Name          string            `yaml:"name"`
+	Claims        map[string]globs  `yaml:"claims"`        // claims and the globs they must match
+	Installations []int64           `yaml:"installations"` // installation ids the token may be for
+	Owners        []string          `yaml:"owners"`        // installation accounts the token may be for, * for any
+	Repositories  []string          `yaml:"repositories"`  // repositories the token may be scoped to, any when empty
+	Permissions   map[string]string `yaml:"permissions"`   // highest permission levels, any when empty
+}
+
+// loadOIDCRules reads the oidc rules file
+func loadOIDCRules(file string) ([]oidcRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read oidc_rules_file: %v", err)
+	}
+
+	rules := struct {
+		Rules []oidcRule `yaml:"rules"`
+	}{}
+	if err = yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse oidc_rules_file: %v", err)
+	}
+
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d in oidc_rules_file has no name", i+1)
+		}
+		if len(rule.Claims) == 0 {
+			return nil, fmt.Errorf("rule %s: claims must be set", rule.Name)
+		}
+		for claim, patterns := range rule.Claims {
+			if err = patterns.validate(); err != nil {
+				return nil, fmt.Errorf("rule %s: %v for claim %s", rule.Name, err, claim)
+			}
+		}
+		if err = validateBrokerCaller(rule.caller()); err != nil {
+			return nil, err
+		}
+	}
+	return rules.Rules, nil
+}
+
+// matches returns true if every claim of the rule matches one of its globs
+func (r oidcRule) matches(claims jwt.MapClaims) bool {
+	for claim, patterns := range r.Claims {
+		value, ok := claimString(claims[claim])
+		if !ok || !patterns.match(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// caller returns the rule as a broker caller, so tokens are authorized the
+// same way as for bearer token callers
+func (r oidcRule) caller() *brokerCaller {
+	return &brokerCaller{
+		Name:          "oidc rule " + r.Name,
+		Installations: r.Installations,
+		Owners:        r.Owners,
+		Repositories:  r.Repositories,
+		Permissions:   r.Permissions,
+	}
+}
+
+// matchOIDCRule returns the first rule matching the claims
+func matchOIDCRule(rules []oidcRule, claims jwt.MapClaims) (*brokerCaller, error) {
+	for _, rule := range rules {
+		if rule.matches(claims) {
+			return rule.caller(), nil
+		}
+	}
+
+	var names []string
+	for claim := range claims {
+		names = append(names, claim)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		if value, ok := claimString(claims[name]); ok {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	return nil, newBrokerError(http.StatusForbidden, "no oidc rule matches the token claims %s", strings.Join(pairs, " "))
+}
+
+// claimString returns a string, number or boolean claim as a string
+func claimString(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// outputData is what the plugin created, passed to each output
+type outputData struct {
+	APIURL       string
+	App          githubapp.AppResponse
+	Installation string
+	JWT          string
+	JWTExpiry    time.Time
+	Token        githubapp.TokenResponse
+	OwnerTokens  []ownerToken // tokens per owner, when repo_names span several owners
+}
+
+// output writes the jwt and token somewhere
+type output interface {
+	// Write writes the data, returning what was written for the card
+	Write(ctx context.Context, data outputData) ([]string, error)
+}
+
+// outputType declares an output. new validates the settings and is only
+// called when the output is enabled.
+type outputType struct {
+	enabled func(args Args) bool
+	new     func(ctx context.Context, args Args) (output, error)
+}
+
+// outputTypes are the outputs in the order they are written
+var outputTypes = []outputType{
+	{
+		enabled: func(args Args) bool { return args.JwtFile != "" },
+		new:     newJwtFileOutput,
+	},
+	{
+		enabled: func(args Args) bool { return args.TokenFile != "" },
+		new:     newTokenFileOutput,
+	},
+	{
+		enabled: func(args Args) bool { return args.JsonFile != "" },
+		new:     newJsonFileOutput,
+	},
+	{
+		enabled: func(args Args) bool { return args.EnvFile != "" },
+		new:     newEnvFileOutput,
+	},
+	{
+		enabled: func(args Args) bool { return args.OutputVariables },
+		new:     newOutputVariablesOutput,
+	},
+	{
+		enabled: func(args Args) bool { return args.JwtSecret != "" || args.TokenSecret != "" || args.JsonSecret != "" },
+		new:     newSecretOutput,
+	},
+}
+
+// newOutputs returns the enabled outputs. It is called before anything is
+// requested from github so misconfigured outputs fail the step early.
+func newOutputs(ctx context.Context, args Args) ([]output, error) {
+	var outputs []output
+	for _, t := range outputTypes {
+		if !t.enabled(args) {
+			continue
+		}
+		o, err := t.new(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, nil
+}
+
+// jsonOutput returns the json written to json_file and json_secret
+func jsonOutput(data outputData) ([]byte, error) {
+	out := JsonOutput{
+		Token: data.Token,
+		Jwt:   data.JWT,
+	}
+	if len(data.OwnerTokens) > 0 {
+		out.Tokens = map[string]githubapp.TokenResponse{}
+		for _, t := range data.OwnerTokens {
+			out.Tokens[t.Owner] = t.Token
+		}
+	}
+	return json.MarshalIndent(out, "", " ")
+}
+
+// fileOutput writes one value to a file readable only by the step user
+type fileOutput struct {
+	kind  string
+	path  string
+	value func(data outputData) ([]byte, error)
+}
+
+func newJwtFileOutput(ctx context.Context, args Args) (output, error) {
+	return &fileOutput{kind: "jwt", path: args.JwtFile, value: func(data outputData) ([]byte, error) {
+		return []byte(data.JWT), nil
+	}}, nil
+}
+
+func newTokenFileOutput(ctx context.Context, args Args) (output, error) {
+	return &fileOutput{kind: "token", path: args.TokenFile, value: func(data outputData) ([]byte, error) {
+		return []byte(data.Token.Token), nil
+	}}, nil
+}
+
+func newJsonFileOutput(ctx context.Context, args Args) (output, error) {
+	return &fileOutput{kind: "json", path: args.JsonFile, value: jsonOutput}, nil
+}
+
+func (o *fileOutput) Write(ctx context.Context, data outputData) ([]string, error) {
+	if o.kind == "token" && data.Installation == "" {
+		log.Println("requested TOKEN_FILE but no INSTALLATION specified, skipping")
+		return nil, nil
+	}
+
+	value, err := o.value(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(o.path, value, 0600); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("%s file %s", o.kind, o.path)}, nil
+}
+
+// envFileOutput writes the variables to env_file
+type envFileOutput struct {
+	path   string
+	format string
+}
+
+func newEnvFileOutput(ctx context.Context, args Args) (output, error) {
+	if args.EnvFormat != "" && args.EnvFormat != "dotenv" && args.EnvFormat != "export" {
+		return nil, fmt.Errorf("unknown env_format '%s': expected dotenv or export", args.EnvFormat)
+	}
+	return &envFileOutput{path: args.EnvFile, format: args.EnvFormat}, nil
+}
+
+func (o *envFileOutput) Write(ctx context.Context, data outputData) ([]string, error) {
+	vars := append(envVars(data.APIURL, data.Installation, data.JWT, data.App, data.Token), ownerTokenVars(data.OwnerTokens)...)
+	if err := writeEnvFile(o.path, o.format, vars); err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("env file %s", o.path)}, nil
+}
+
+// outputVariablesOutput writes the variables as step outputs
+type outputVariablesOutput struct {
+	outputFile   string
+	secretFile   string
+	plainSecrets bool
+}
+
+func newOutputVariablesOutput(ctx context.Context, args Args) (output, error) {
+	if args.OutputFile == "" {
+		return nil, errors.New("output_variables requires the runner to provide DRONE_OUTPUT")
+	}
+	return &outputVariablesOutput{outputFile: args.OutputFile, secretFile: args.OutputSecret, plainSecrets: args.OutputPlainSecrets}, nil
+}
+
+func (o *outputVariablesOutput) Write(ctx context.Context, data outputData) ([]string, error) {
+	vars := append(envVars(data.APIURL, data.Installation, data.JWT, data.App, data.Token), ownerTokenVars(data.OwnerTokens)...)
+	if err := writeOutputVariables(o.outputFile, o.secretFile, o.plainSecrets, vars); err != nil {
+		return nil, err
+	}
+	log.Println(fmt.Sprintf("output variables written to %s", o.outputFile))
+	return []string{"step output variables"}, nil
+}
+
+// secretOutput writes jwt_secret, token_secret and json_secret to the
+// secret sink
+type secretOutput struct {
+	sink        SecretSink
+	jwtSecret   string
+	tokenSecret string
+	jsonSecret  string
+}
+
+func newSecretOutput(ctx context.Context, args Args) (output, error) {
+	sink, err := newSecretSink(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &secretOutput{
+		sink:        sink,
+		jwtSecret:   args.JwtSecret,
+		tokenSecret: args.TokenSecret,
+		jsonSecret:  args.JsonSecret,
+	}, nil
+}
+
+func (o *secretOutput) Write(ctx context.Context, data outputData) ([]string, error) {
+	var tokenExpiry time.Time
+	if data.Token.ExpiresAt != "" {
+		tokenExpiry, _ = time.Parse(time.RFC3339, data.Token.ExpiresAt)
+	}
+
+	var toStore []Secret
+	if o.jwtSecret != "" {
+		toStore = append(toStore, Secret{ID: o.jwtSecret, Kind: "jwt", Value: data.JWT, ExpiresAt: data.JWTExpiry})
+	}
+	if o.tokenSecret != "" {
+		toStore = append(toStore, Secret{ID: o.tokenSecret, Kind: "token", Value: data.Token.Token, ExpiresAt: tokenExpiry})
+	}
+	if o.jsonSecret != "" {
+		file, err := jsonOutput(data)
+		if err != nil {
+			return nil, err
+		}
+		toStore = append(toStore, Secret{ID: o.jsonSecret, Kind: "json", Value: string(file), ExpiresAt: tokenExpiry})
+	}
+
+	var written []string
+	for _, secret := range toStore {
+		secret.App = data.App.Slug
+		secret.Installation = data.Installation
+		if err := o.sink.Store(ctx, secret); err != nil {
+			return written, err
+		}
+		log.Println(fmt.Sprintf("%s saved in %s", secret.Kind, secret.ID))
+		written = append(written, fmt.Sprintf("%s secret %s", o.sink.Name(), secret.ID))
+	}
+	return written, nil
+}
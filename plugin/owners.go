@@ -0,0 +1,194 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// ownerToken is the token for the repositories of one owner, when repo_names
+// include owner/repo names
+type ownerToken struct {
+	Owner        string
+	Installation githubapp.InstallationResponse
+	Options      githubapp.TokenOptions // the resolved scope, used to refresh the token
+	Token        githubapp.TokenResponse
+	Cached       bool
+	Source       *githubapp.InstallationTokenSource // refreshes the token for a command
+}
+
+// hasRepositoryOwners returns true when any repository name includes the
+// owner
+func hasRepositoryOwners(names []string) bool {
+	for _, name := range names {
+		if strings.Contains(name, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// groupRepositories groups repository names by owner, in the order the owners
+// first appear. Names without an owner belong to defaultOwner.
+func groupRepositories(names []string, defaultOwner string) (owners []string, groups map[string][]string, err error) {
+	groups = map[string][]string{}
+	for _, name := range names {
+		owner := defaultOwner
+		if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+			owner, name = parts[0], parts[1]
+		} else if owner == "" {
+			return nil, nil, fmt.Errorf("repository name '%s' needs an owner when no installation is known - use owner/repository", name)
+		}
+
+		key := strings.ToLower(owner)
+		if _, ok := groups[key]; !ok {
+			owners = append(owners, owner)
+		}
+		if !containsFold(groups[key], name) {
+			groups[key] = append(groups[key], name)
+		}
+	}
+	return owners, groups, nil
+}
+
+// mintOwnerTokens creates one token per owner of the repositories in opts,
+// each from the installation on that owner. The names are resolved to ids
+// first so renamed repositories keep working. The token of the first owner
+// is returned first.
+func mintOwnerTokens(ctx context.Context, github *githubapp.Client, jwt, issuer string, args Args, opts githubapp.TokenOptions) ([]ownerToken, error) {
+	// names without an owner belong to the installation the plugin would
+	// otherwise have used
+	var installation githubapp.InstallationResponse
+	defaultOwner, _ := installationLookup(args)
+	if args.Installation != "" {
+		id, err := strconv.ParseInt(args.Installation, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid installation '%s': %v", args.Installation, err)
+		}
+		if installation, err = github.Installation(ctx, jwt, id); err != nil {
+			return nil, err
+		}
+		defaultOwner = installation.Account.Login
+	}
+
+	owners, groups, err := groupRepositories(opts.Repositories, defaultOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	// an explicit installation only has access to its own account
+	if installation.ID != 0 {
+		for _, owner := range owners {
+			if !strings.EqualFold(owner, installation.Account.Login) {
+				return nil, fmt.Errorf("repository %s/%s does not belong to installation %d on %s - remove installation to get a token per owner", owner, groups[strings.ToLower(owner)][0], installation.ID, installation.Account.Login)
+			}
+		}
+	}
+
+	var cache *tokenCache
+	if args.CacheDir != "" {
+		cache = newTokenCache(args.CacheDir, args.CacheKey, args.CacheMinLifetime)
+	}
+
+	var tokens []ownerToken
+	for _, owner := range owners {
+		names := groups[strings.ToLower(owner)]
+
+		t := ownerToken{Owner: owner, Installation: installation}
+		if t.Installation.ID == 0 {
+			if t.Installation, err = github.FindInstallation(ctx, jwt, owner, ""); err != nil {
+				return nil, err
+			}
+			log.Println(fmt.Sprintf("using installation %d on %s", t.Installation.ID, t.Installation.Account.Login))
+		}
+
+		// the cache is keyed on the names so a cached token skips resolving
+		// them again
+		cacheKey := tokenCacheKey(github.BaseURL, issuer, t.Installation.ID, githubapp.TokenOptions{Repositories: names, Permissions: opts.Permissions})
+		if cache != nil {
+			t.Token, t.Cached = cache.get(cacheKey)
+		}
+		if t.Cached {
+			log.Println(fmt.Sprintf("reusing cached token for %s from %s", owner, args.CacheDir))
+			t.Options = githubapp.TokenOptions{Permissions: opts.Permissions}
+			for _, repo := range t.Token.Repositories {
+				t.Options.RepositoryIDs = append(t.Options.RepositoryIDs, repo.ID)
+			}
+		} else {
+			ids, err := resolveRepositoryIDs(ctx, github, jwt, t.Installation.ID, owner, names)
+			if err != nil {
+				return nil, err
+			}
+			t.Options = githubapp.TokenOptions{RepositoryIDs: ids, Permissions: opts.Permissions}
+			if t.Token, err = github.CreateInstallationToken(ctx, jwt, t.Installation.ID, t.Options); err != nil {
+				return nil, err
+			}
+			if cache != nil {
+				if err = cache.put(cacheKey, t.Token); err != nil {
+					log.Println(fmt.Sprintf("unable to cache token: %v", err))
+				}
+			}
+		}
+
+		log.Println(fmt.Sprintf("token for %s:", owner))
+		logToken(t.Token)
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// resolveRepositoryIDs looks up the ids of the repositories of owner with a
+// metadata:read token that is revoked afterwards
+func resolveRepositoryIDs(ctx context.Context, github *githubapp.Client, jwt string, installation int64, owner string, names []string) ([]int, error) {
+	lookup, err := github.CreateInstallationToken(ctx, jwt, installation, githubapp.TokenOptions{Permissions: map[string]string{"metadata": "read"}})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := github.RevokeInstallationToken(ctx, lookup.Token); err != nil {
+			log.Println(fmt.Sprintf("unable to revoke the repository lookup token: %v", err))
+		}
+	}()
+
+	var ids []int
+	for _, name := range names {
+		repo, err := github.Repository(ctx, lookup.Token, owner, name)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(repo.Owner.Login, owner) {
+			return nil, fmt.Errorf("repository %s/%s was transferred to %s", owner, name, repo.FullName)
+		}
+		if !strings.EqualFold(repo.Name, name) {
+			log.Println(fmt.Sprintf("repository %s/%s was renamed to %s", owner, name, repo.FullName))
+		}
+		ids = append(ids, repo.ID)
+	}
+	return ids, nil
+}
+
+// ownerVarName matches what cannot be in a variable name
+var ownerVarName = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// ownerTokenVar returns GITHUB_TOKEN_<OWNER>
+func ownerTokenVar(owner string) string {
+	return "GITHUB_TOKEN_" + ownerVarName.ReplaceAllString(strings.ToUpper(owner), "_")
+}
+
+// ownerTokenVars returns GITHUB_TOKEN_<OWNER> for each owner token
+func ownerTokenVars(tokens []ownerToken) []envVar {
+	var vars []envVar
+	for _, t := range tokens {
+		vars = append(vars, envVar{Name: ownerTokenVar(t.Owner), Value: t.Token.Token, Secret: true})
+	}
+	return vars
+}
@@ -60,8 +60,8 @@ type Pipeline struct {
 
 	// Deploy provides the deployment metadata.
 	Deploy struct {
-		ID     string `envconfig:"DRONE_DEPLOY_TO"`
-		Target string `envconfig:"DRONE_DEPLOY_ID"`
+		ID     string `envconfig:"DRONE_DEPLOY_ID"`
+		Target string `envconfig:"DRONE_DEPLOY_TO"`
 	}
 
 	// Failed provides a list of failed steps and failed stages
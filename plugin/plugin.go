@@ -6,8 +6,8 @@ package plugin
 
 import (
 	"context"
+	"crypto/rsa"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -16,9 +16,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/rssnyder/harness-go-utils/config"
-	"github.com/rssnyder/harness-go-utils/secrets"
+	"github.om/rssnyder/drone-github-app/githubapp"
 )
 
 // Args provides plugin execution arguments.
@@ -29,64 +27,215 @@ type Args struct {
 	Level string `envconfig:"PLUGIN_LOG_LEVEL"`
 
 	// TODO replace or remove
-	AppId         string `envconfig:"PLUGIN_APP_ID"`
-	ClientId      string `envconfig:"PLUGIN_CLIENT_ID"` // Recommended alternative to APP_ID
-	Pem           string `envconfig:"PLUGIN_PEM"`
-	PemFile       string `envconfig:"PLUGIN_PEM_FILE"`
-	PemB64        string `envconfig:"PLUGIN_PEM_B64"`
-	Installation  string `envconfig:"PLUGIN_INSTALLATION"`
-	JwtFile       string `envconfig:"PLUGIN_JWT_FILE"`
-	TokenFile     string `envconfig:"PLUGIN_TOKEN_FILE"`
-	JsonFile      string `envconfig:"PLUGIN_JSON_FILE"`
-	JwtSecret     string `envconfig:"PLUGIN_JWT_SECRET"`
-	TokenSecret   string `envconfig:"PLUGIN_TOKEN_SECRET"`
-	JsonSecret    string `envconfig:"PLUGIN_JSON_SECRET"`
-	SecretManager string `envconfig:"PLUGIN_SECRET_MANAGER"`
+	AppId             string   `envconfig:"PLUGIN_APP_ID"`
+	ClientId          string   `envconfig:"PLUGIN_CLIENT_ID"` // Recommended alternative to APP_ID
+	Pem               string   `envconfig:"PLUGIN_PEM"`
+	PemFile           string   `envconfig:"PLUGIN_PEM_FILE"`
+	PemB64            string   `envconfig:"PLUGIN_PEM_B64"`
+	PemVault          string   `envconfig:"PLUGIN_PEM_VAULT"`           // Vault kv path#field holding the private key
+	PemKubernetes     string   `envconfig:"PLUGIN_PEM_KUBERNETES"`      // Kubernetes secret [namespace/]name#key holding the private key
+	PemFiles          []string `envconfig:"PLUGIN_PEM_FILES"`           // Files holding more private keys, tried in order during key rotation
+	PemsB64           []string `envconfig:"PLUGIN_PEMS_B64"`            // Base64 encoded private keys, tried in order during key rotation
+	PemCommand        string   `envconfig:"PLUGIN_PEM_COMMAND"`         // Command printing the private key
+	PemPassphrase     string   `envconfig:"PLUGIN_PEM_PASSPHRASE"`      // Passphrase of an encrypted private key
+	PemPassphraseFile string   `envconfig:"PLUGIN_PEM_PASSPHRASE_FILE"` // File holding the passphrase of an encrypted private key
+	Signer            string   `envconfig:"PLUGIN_SIGNER"`              // What signs the app jwt: pem (default), pkcs11, aws-kms, gcp-kms or vault-transit
+	SignerKey         string   `envconfig:"PLUGIN_SIGNER_KEY"`          // Key used by the signer: kms key id or name, transit key or pkcs11 key label
+	Installation      string   `envconfig:"PLUGIN_INSTALLATION"`
+	JwtFile           string   `envconfig:"PLUGIN_JWT_FILE"`
+	TokenFile         string   `envconfig:"PLUGIN_TOKEN_FILE"`
+	JsonFile          string   `envconfig:"PLUGIN_JSON_FILE"`
+	JwtSecret         string   `envconfig:"PLUGIN_JWT_SECRET"`
+	TokenSecret       string   `envconfig:"PLUGIN_TOKEN_SECRET"`
+	JsonSecret        string   `envconfig:"PLUGIN_JSON_SECRET"`
+	SecretManager     string   `envconfig:"PLUGIN_SECRET_MANAGER"`
+	SecretSink        string   `envconfig:"PLUGIN_SECRET_SINK"` // Where jwt_secret, token_secret and json_secret are stored: harness (default), vault, kubernetes, aws-secrets-manager or aws-ssm
+
+	// Harness secrets
+	SecretScope       string `envconfig:"PLUGIN_SECRET_SCOPE"`                       // account, org or project, defaults to the org and project in the environment
+	SecretName        string `envconfig:"PLUGIN_SECRET_NAME"`                        // Display name of created secrets, defaults to the secret id
+	SecretDescription string `envconfig:"PLUGIN_SECRET_DESCRIPTION"`                 // Description, defaults to the app, installation and expiry
+	SecretTags        string `envconfig:"PLUGIN_SECRET_TAGS"`                        // Comma-separated key=value tags
+	SecretWriteMode   string `envconfig:"PLUGIN_SECRET_WRITE_MODE" default:"upsert"` // upsert, create (fail if it exists) or update (fail if missing)
+	HarnessAPIKey     string `envconfig:"PLUGIN_HARNESS_API_KEY"`                    // Harness api key, defaults to HARNESS_PLATFORM_API_KEY
+	HarnessAccountID  string `envconfig:"PLUGIN_HARNESS_ACCOUNT_ID"`                 // Harness account, defaults to HARNESS_ACCOUNT_ID
+	HarnessOrg        string `envconfig:"PLUGIN_HARNESS_ORG"`                        // Harness organization, defaults to HARNESS_PLATFORM_ORGANIZATION
+	HarnessProject    string `envconfig:"PLUGIN_HARNESS_PROJECT"`                    // Harness project, defaults to HARNESS_PLATFORM_PROJECT
+	HarnessEndpoint   string `envconfig:"PLUGIN_HARNESS_ENDPOINT"`                   // Harness api url, defaults to HARNESS_ENDPOINT or https://app.harness.io/gateway
 
 	// Repository selection (mutually exclusive)
-	RepoIDs     string `envconfig:"PLUGIN_REPO_IDS"`     // Comma-separated list of repository IDs
-	RepoNames   string `envconfig:"PLUGIN_REPO_NAMES"`   // Comma-separated list of repository names
+	RepoIDs     string `envconfig:"PLUGIN_REPO_IDS"`      // Comma-separated list of repository IDs
+	RepoNames   string `envconfig:"PLUGIN_REPO_NAMES"`    // Comma-separated list of repository names
 	RepoIDsFile string `envconfig:"PLUGIN_REPO_IDS_FILE"` // File containing repository IDs
 
 	// Permissions for installation token
 	Permissions string `envconfig:"PLUGIN_PERMISSIONS"` // Comma-separated list of permissions (e.g., "contents:read,issues:write")
-}
-
-// AppResponse is what github returns when querying yourself
-type AppResponse struct {
-	ID   int    `json:"id"`
-	Slug string `json:"slug"`
-}
-
-// TokenResponse is what github returns when gettting an installation token
-type TokenResponse struct {
-	Token              string                    `json:"token"`
-	ExpiresAt          string                    `json:"expires_at"`
-	Permissions        map[string]string         `json:"permissions,omitempty"`
-	RepositorySelection string                   `json:"repository_selection,omitempty"`
-	Repositories       []TokenResponseRepository `json:"repositories,omitempty"`
-}
 
-// TokenResponseRepository represents a repository in the token response
-type TokenResponseRepository struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	// Least privilege, scopes tokens without repo_ids or repo_names to the
+	// pipeline repository and allow_repos, and tokens without permissions to
+	// metadata:read
+	LeastPrivilege bool   `envconfig:"PLUGIN_LEAST_PRIVILEGE"`
+	AllowRepos     string `envconfig:"PLUGIN_ALLOW_REPOS"` // Comma-separated repository names added to the pipeline repository
+
+	// PolicyFile limits the token scope by build event, branch, repository,
+	// deploy target and tag, in addition to /etc/drone-github-app/policy.yaml
+	PolicyFile string `envconfig:"PLUGIN_POLICY_FILE"`
+
+	// Installation discovery, used when no installation id is given. Defaults
+	// to the drone repository when a token output is requested.
+	InstallationOwner string `envconfig:"PLUGIN_INSTALLATION_OWNER"` // Organization or user the app is installed on
+	InstallationRepo  string `envconfig:"PLUGIN_INSTALLATION_REPO"`  // Repository the app is installed on (name or owner/name)
+
+	// APIURL is the github rest api base url. When empty it is derived from
+	// the repository link when it is on a known github host, falling back to
+	// https://api.github.com
+	APIURL string `envconfig:"PLUGIN_API_URL"`
+
+	// GitHubHosts are enterprise server hosts, the api url is derived from
+	// the repository link or drone system host when it is one of them
+	GitHubHosts []string `envconfig:"PLUGIN_GITHUB_HOSTS"`
+
+	// HTTP client settings for github api calls
+	HTTPTimeout time.Duration `envconfig:"PLUGIN_HTTP_TIMEOUT" default:"30s"` // Timeout for each request attempt
+	HTTPRetries int           `envconfig:"PLUGIN_HTTP_RETRIES" default:"4"`   // Retries for network errors, server errors and rate limits
+
+	// Mode selects what the plugin does: "token" (default) creates a jwt and
+	// installation token, "revoke" revokes a previously created token and
+	// "serve" runs the token broker
+	Mode string `envconfig:"PLUGIN_MODE"`
+
+	// Token broker, run with the serve command or serve mode
+	ServeAddr        string `envconfig:"PLUGIN_SERVE_ADDR" default:":8080"` // Address to listen on
+	ServeCallersFile string `envconfig:"PLUGIN_SERVE_CALLERS_FILE"`         // YAML file of the callers and what they may request
+	ServeTLSCert     string `envconfig:"PLUGIN_SERVE_TLS_CERT"`             // TLS certificate, serves plain http when not set
+	ServeTLSKey      string `envconfig:"PLUGIN_SERVE_TLS_KEY"`              // TLS private key
+
+	// OIDC token exchange at the broker
+	OIDCIssuer    string `envconfig:"PLUGIN_OIDC_ISSUER"`     // Issuer of the id tokens
+	OIDCAudience  string `envconfig:"PLUGIN_OIDC_AUDIENCE"`   // Audience the id tokens must be for
+	OIDCJWKSURL   string `envconfig:"PLUGIN_OIDC_JWKS_URL"`   // Issuer keys, defaults to the jwks_uri of the issuer discovery document
+	OIDCJWKSFile  string `envconfig:"PLUGIN_OIDC_JWKS_FILE"`  // Local issuer keys, e.g. for testing without the issuer
+	OIDCRulesFile string `envconfig:"PLUGIN_OIDC_RULES_FILE"` // YAML file mapping id token claims to what may be requested
+
+	// Token broker client, creates the token at the broker instead of with
+	// the app private key
+	BrokerURL     string `envconfig:"PLUGIN_BROKER_URL"`      // Broker base url
+	BrokerToken   string `envconfig:"PLUGIN_BROKER_TOKEN"`    // Caller token for the broker
+	OIDCToken     string `envconfig:"PLUGIN_OIDC_TOKEN"`      // OIDC id token to exchange at the broker
+	OIDCTokenFile string `envconfig:"PLUGIN_OIDC_TOKEN_FILE"` // File holding the oidc id token
+
+	// Token revocation, read from token_file or json_file when neither is set
+	RevokeToken     string `envconfig:"PLUGIN_REVOKE_TOKEN"`      // Token to revoke, e.g. from a harness secret expression
+	RevokeTokenFile string `envconfig:"PLUGIN_REVOKE_TOKEN_FILE"` // File written by token_file or json_file
+
+	// Command runs with the installation token in its environment instead of
+	// writing the token to the workspace. CommandArgs are set from the plugin
+	// arguments after "--" and take precedence over the shell command.
+	Command     string   `envconfig:"PLUGIN_COMMAND"`
+	CommandArgs []string `ignored:"true"`
+
+	// CommandKeepEnv names credential variables passed to the command anyway,
+	// e.g. AWS_ACCESS_KEY_ID for a command using the aws cli
+	CommandKeepEnv []string `envconfig:"PLUGIN_COMMAND_KEEP_ENV"`
+
+	// CredentialCacheDir holds tokens created by the git-credential helper,
+	// defaults to the user cache directory
+	CredentialCacheDir string `envconfig:"PLUGIN_CREDENTIAL_CACHE_DIR"`
+
+	// Token cache shared between steps, disabled unless a directory is set
+	CacheDir         string        `envconfig:"PLUGIN_CACHE_DIR"`                        // Directory in the shared workspace to cache tokens in
+	CacheKey         string        `envconfig:"PLUGIN_CACHE_KEY"`                        // Passphrase to encrypt cached tokens with
+	CacheMinLifetime time.Duration `envconfig:"PLUGIN_CACHE_MIN_LIFETIME" default:"10m"` // Minimum remaining lifetime of a cached token to reuse it
+
+	// Env file and step output variables
+	EnvFile            string `envconfig:"PLUGIN_ENV_FILE"`                    // Output file for the token and metadata as variables
+	EnvFormat          string `envconfig:"PLUGIN_ENV_FORMAT" default:"dotenv"` // Format of env_file, dotenv or export
+	OutputVariables    bool   `envconfig:"PLUGIN_OUTPUT_VARIABLES"`            // Write variables to the step output files
+	OutputPlainSecrets bool   `envconfig:"PLUGIN_OUTPUT_PLAIN_SECRETS"`        // Write the jwt and tokens to DRONE_OUTPUT when there is no secret output file
+	OutputFile         string `envconfig:"DRONE_OUTPUT"`                       // Output variables file provided by the runner
+	OutputSecret       string `envconfig:"HARNESS_OUTPUT_SECRET_FILE"`         // Secret output variables file provided by harness
+
+	// Vault secret sink
+	VaultAddr       string `envconfig:"PLUGIN_VAULT_ADDR"`                                                                   // Vault address, defaults to VAULT_ADDR
+	VaultNamespace  string `envconfig:"PLUGIN_VAULT_NAMESPACE"`                                                              // Vault enterprise namespace, defaults to VAULT_NAMESPACE
+	VaultMount      string `envconfig:"PLUGIN_VAULT_MOUNT" default:"secret"`                                                 // KV secrets engine mount
+	VaultKVVersion  int    `envconfig:"PLUGIN_VAULT_KV_VERSION" default:"2"`                                                 // KV secrets engine version, 1 or 2
+	VaultField      string `envconfig:"PLUGIN_VAULT_FIELD" default:"value"`                                                  // Field of the KV secret holding the value
+	VaultAuthMethod string `envconfig:"PLUGIN_VAULT_AUTH_METHOD" default:"token"`                                            // token, approle or kubernetes
+	VaultAuthMount  string `envconfig:"PLUGIN_VAULT_AUTH_MOUNT"`                                                             // Auth method mount, defaults to the method name
+	VaultToken      string `envconfig:"PLUGIN_VAULT_TOKEN"`                                                                  // Token for token auth, defaults to VAULT_TOKEN
+	VaultRoleID     string `envconfig:"PLUGIN_VAULT_ROLE_ID"`                                                                // Role id for approle auth
+	VaultSecretID   string `envconfig:"PLUGIN_VAULT_SECRET_ID"`                                                              // Secret id for approle auth
+	VaultRole       string `envconfig:"PLUGIN_VAULT_ROLE"`                                                                   // Role for kubernetes auth
+	VaultJWTFile    string `envconfig:"PLUGIN_VAULT_JWT_FILE" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"` // Service account token for kubernetes auth
+
+	// Kubernetes secret sink
+	Kubeconfig       string `envconfig:"PLUGIN_KUBECONFIG"`                     // Kubeconfig file, defaults to KUBECONFIG or the in cluster service account
+	KubeContext      string `envconfig:"PLUGIN_KUBE_CONTEXT"`                   // Kubeconfig context, defaults to the current context
+	KubeNamespace    string `envconfig:"PLUGIN_KUBE_NAMESPACE"`                 // Namespace of the secrets, defaults to the context or pod namespace
+	KubeTokenKey     string `envconfig:"PLUGIN_KUBE_TOKEN_KEY" default:"token"` // Secret key holding the token
+	KubeJwtKey       string `envconfig:"PLUGIN_KUBE_JWT_KEY" default:"jwt"`     // Secret key holding the jwt
+	KubeJsonKey      string `envconfig:"PLUGIN_KUBE_JSON_KEY" default:"json"`   // Secret key holding the json output
+	KubeLabels       string `envconfig:"PLUGIN_KUBE_LABELS"`                    // Comma-separated key=value labels
+	KubeAnnotations  string `envconfig:"PLUGIN_KUBE_ANNOTATIONS"`               // Comma-separated key=value annotations
+	KubeManifestFile string `envconfig:"PLUGIN_KUBE_MANIFEST_FILE"`             // Write the secret manifests to this file instead of applying them
+	KubeSecretType   string `envconfig:"PLUGIN_KUBE_SECRET_TYPE"`               // Opaque, kubernetes.io/dockerconfigjson or kubernetes.io/basic-auth
+	KubeRegistry     string `envconfig:"PLUGIN_KUBE_REGISTRY"`                  // Registry of dockerconfigjson secrets, defaults to ghcr.io
+	KubeUsername     string `envconfig:"PLUGIN_KUBE_USERNAME"`                  // Username of dockerconfigjson and basic-auth secrets, defaults to x-access-token
+
+	// AWS secret sinks
+	AWSRegion          string `envconfig:"PLUGIN_AWS_REGION"`            // Region, defaults to AWS_REGION
+	AWSEndpoint        string `envconfig:"PLUGIN_AWS_ENDPOINT"`          // Endpoint override, e.g. for localstack
+	AWSAccessKeyID     string `envconfig:"PLUGIN_AWS_ACCESS_KEY_ID"`     // Access key, defaults to the standard aws credential sources
+	AWSSecretAccessKey string `envconfig:"PLUGIN_AWS_SECRET_ACCESS_KEY"` // Secret key for aws_access_key_id
+	AWSSessionToken    string `envconfig:"PLUGIN_AWS_SESSION_TOKEN"`     // Session token for temporary credentials
+	AWSKMSKeyID        string `envconfig:"PLUGIN_AWS_KMS_KEY_ID"`        // KMS key to encrypt secrets with, defaults to the aws managed key
+	AWSTags            string `envconfig:"PLUGIN_AWS_TAGS"`              // Comma-separated key=value tags
+
+	// Signers
+	PKCS11Module       string `envconfig:"PLUGIN_PKCS11_MODULE"`                         // PKCS#11 module, e.g. /usr/lib/softhsm/libsofthsm2.so
+	PKCS11Token        string `envconfig:"PLUGIN_PKCS11_TOKEN"`                          // PKCS#11 token label
+	PKCS11Slot         string `envconfig:"PLUGIN_PKCS11_SLOT"`                           // PKCS#11 slot id, when no token label is set
+	PKCS11Pin          string `envconfig:"PLUGIN_PKCS11_PIN"`                            // PKCS#11 user pin
+	PKCS11Tool         string `envconfig:"PLUGIN_PKCS11_TOOL" default:"pkcs11-tool"`     // OpenSC pkcs11-tool binary
+	GCPAccessToken     string `envconfig:"PLUGIN_GCP_ACCESS_TOKEN"`                      // GCP access token, defaults to the credentials file or metadata server
+	GCPCredentialsFile string `envconfig:"PLUGIN_GCP_CREDENTIALS_FILE"`                  // GCP service account key, defaults to GOOGLE_APPLICATION_CREDENTIALS
+	GCPKMSEndpoint     string `envconfig:"PLUGIN_GCP_KMS_ENDPOINT"`                      // Cloud KMS endpoint override
+	VaultTransitMount  string `envconfig:"PLUGIN_VAULT_TRANSIT_MOUNT" default:"transit"` // Vault transit secrets engine mount
 }
 
 // JsonOutput is custom output for json file
 type JsonOutput struct {
-	Token           TokenResponse `json:"token"`
-	Jwt             string        `json:"jwt"`
+	Token  githubapp.TokenResponse            `json:"token"`
+	Jwt    string                             `json:"jwt"`
+	Tokens map[string]githubapp.TokenResponse `json:"tokens,omitempty"` // Tokens by owner, when repo_names span several owners
 }
 
 // Exec executes the plugin.
 func Exec(ctx context.Context, args Args) (err error) {
+	// the policy is loaded before anything else so no mode gets around it
+	policies, err := policyFiles(args)
+	if err != nil {
+		return err
+	}
 
-	if args.AppId == "" && args.ClientId == "" {
-		return errors.New("either app_id or client_id needs to be set")
+	switch {
+	case args.Mode == "revoke" || args.RevokeToken != "" || args.RevokeTokenFile != "":
+		return revoke(ctx, args)
+	case args.Mode == "serve":
+		return Serve(ctx, args)
+	case args.Mode != "" && args.Mode != "token":
+		return fmt.Errorf("unknown mode '%s': expected token, revoke or serve", args.Mode)
 	}
 
-	if args.AppId != "" && args.ClientId != "" {
+	switch {
+	case args.BrokerURL != "":
+		if err = validateBrokerArgs(args); err != nil {
+			return err
+		}
+	case args.AppId == "" && args.ClientId == "":
+		return errors.New("either app_id or client_id needs to be set")
+	case args.AppId != "" && args.ClientId != "":
 		return errors.New("only one of app_id or client_id should be set, not both. Prefer client_id for future GHEC with Data Residency compatibility.")
 	}
 
@@ -96,28 +245,43 @@ func Exec(ctx context.Context, args Args) (err error) {
 		return err
 	}
 
-	var bPem []byte
-	if args.Pem != "" {
-		bPem = []byte(args.Pem)
-	} else if args.PemFile != "" {
-		bPem, err = os.ReadFile(args.PemFile)
-		if err != nil {
-			fmt.Print(err)
-		}
-	} else if args.PemB64 != "" {
-		bPem, err = base64.StdEncoding.DecodeString(args.PemB64)
+	if owner, _ := installationLookup(args); hasCommand(args) && args.Installation == "" && owner == "" {
+		return errors.New("installation, installation_owner or installation_repo must be specified when running a command")
+	}
+
+	// the app jwt can create a token for any installation, so it is not
+	// handed out when a policy limits the tokens
+	if len(policies) > 0 && (args.JwtFile != "" || args.JwtSecret != "") {
+		return errors.New("jwt_file and jwt_secret cannot be used with a policy file: the app jwt is not limited by the policy")
+	}
+
+	// check the token scope against the policy before anything is requested
+	// from github. The policy is evaluated without an installation too, so a
+	// denied build fails.
+	var opts githubapp.TokenOptions
+	if owner, _ := installationLookup(args); args.Installation != "" || owner != "" {
+		opts, err = tokenOptions(args)
 		if err != nil {
-			fmt.Print(err)
+			return err
 		}
-	} else {
-		return errors.New("one of pem, pam_file, or pem_b64 must be set")
+	}
+	opts, err = applyPolicy(args, policies, opts)
+	if err != nil {
+		return err
+	}
+
+	// set up the outputs first so a misconfigured output fails the step
+	// before anything is requested from github
+	outputs, err := newOutputs(ctx, args)
+	if err != nil {
+		return err
 	}
 
-	if len(bPem) == 0 {
-		return errors.New("unable to parse pem")
+	if args.BrokerURL != "" {
+		return brokerExec(ctx, args, opts, outputs)
 	}
 
-	signKey, err := jwt.ParseRSAPrivateKeyFromPEM(bPem)
+	signers, err := newSigners(ctx, args)
 	if err != nil {
 		return err
 	}
@@ -128,136 +292,349 @@ func Exec(ctx context.Context, args Args) (err error) {
 		issuer = args.ClientId
 	}
 
-	builtToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"iat": time.Now().Unix(),
-		"exp": time.Now().Add(time.Minute * time.Duration(10)).Unix(),
-		"iss": issuer,
-	})
-
-	jwtSigned, err := builtToken.SignedString(signKey)
+	github, err := newClient(args)
 	if err != nil {
 		return err
 	}
 
-	appData, err := validateJWT(jwtSigned)
+	app, appToken, appData, err := authenticateApp(ctx, github, issuer, signers)
 	if err != nil {
 		return err
 	}
+	jwtSigned := appToken.AccessToken
 
 	log.Println(fmt.Sprintf("authenticated as %s", appData.Slug))
 
-	var tokenData TokenResponse
-	if args.Installation != "" {
-		// Parse repository data if any repository selection is specified
-		var repoData map[string]interface{}
-		if args.RepoIDs != "" || args.RepoNames != "" || args.RepoIDsFile != "" {
-			repoData, err = parseRepositoryData(args)
-			if err != nil {
-				return err
-			}
+	// owner/repo names are looked up per owner
+	owners := hasRepositoryOwners(opts.Repositories)
+
+	var installation githubapp.InstallationResponse
+	if owner, repo := installationLookup(args); args.Installation == "" && owner != "" && !owners {
+		installation, err = github.FindInstallation(ctx, jwtSigned, owner, repo)
+		if err != nil {
+			return err
 		}
-		
-		// Parse permissions if provided
-		var permissions map[string]string
-		if args.Permissions != "" {
-			permissions, err = parsePermissions(args.Permissions)
-			if err != nil {
+		args.Installation = strconv.FormatInt(installation.ID, 10)
+		log.Println(fmt.Sprintf("using installation %s on %s", args.Installation, installation.Account.Login))
+	}
+
+	var tokenData githubapp.TokenResponse
+	var source *githubapp.InstallationTokenSource
+	var cached bool
+	var ownerTokens []ownerToken
+	if owners {
+		ownerTokens, err = mintOwnerTokens(ctx, github, jwtSigned, issuer, args, opts)
+		if err != nil {
+			return err
+		}
+
+		for i := range ownerTokens {
+			t := &ownerTokens[i]
+			t.Source = githubapp.NewInstallationTokenSource(github, app, t.Installation.ID, t.Options)
+			t.Source.Context = ctx
+		}
+
+		// the first owner gets the usual outputs
+		primary := ownerTokens[0]
+		installation, tokenData, cached, source = primary.Installation, primary.Token, primary.Cached, primary.Source
+		args.Installation = strconv.FormatInt(installation.ID, 10)
+
+		if len(ownerTokens) == 1 {
+			ownerTokens = nil
+		}
+	} else if args.Installation != "" {
+		installationID, err := strconv.ParseInt(args.Installation, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid installation '%s': %v", args.Installation, err)
+		}
+
+		// least_privilege picks the pipeline repository before the
+		// installation owner is known
+		if leastPrivilegeRepo(args, opts) {
+			if installation.ID == 0 {
+				if installation, err = github.Installation(ctx, jwtSigned, installationID); err != nil {
+					return err
+				}
+			}
+			if opts, err = leastPrivilegeInstallation(args, installation.Account.Login, opts); err != nil {
 				return err
 			}
 		}
-		
-		tokenData, err = installationToken(jwtSigned, args.Installation, repoData, permissions)
-		if err != nil {
-			return err
+
+		var cache *tokenCache
+		cacheKey := tokenCacheKey(github.BaseURL, issuer, installationID, opts)
+		if args.CacheDir != "" {
+			cache = newTokenCache(args.CacheDir, args.CacheKey, args.CacheMinLifetime)
 		}
 
-		// Log token information including repository details
-		logMsg := fmt.Sprintf("token received, expires %s", tokenData.ExpiresAt)
-		if len(tokenData.Repositories) > 0 {
-			logMsg += fmt.Sprintf(", repositories: %d", len(tokenData.Repositories))
-			for _, repo := range tokenData.Repositories {
-				log.Println(fmt.Sprintf("  - %s (ID: %d)", repo.Name, repo.ID))
+		if cache != nil {
+			tokenData, cached = cache.get(cacheKey)
+		}
+
+		// names are resolved to ids so renamed repositories keep working. The
+		// cache is keyed on the names so a cached token skips resolving them
+		// again.
+		if len(opts.Repositories) > 0 {
+			ids := opts.RepositoryIDs
+			if cached {
+				ids = nil
+				for _, repo := range tokenData.Repositories {
+					ids = append(ids, repo.ID)
+				}
+			} else {
+				if installation.ID == 0 {
+					if installation, err = github.Installation(ctx, jwtSigned, installationID); err != nil {
+						return err
+					}
+				}
+				resolved, err := resolveRepositoryIDs(ctx, github, jwtSigned, installationID, installation.Account.Login, opts.Repositories)
+				if err != nil {
+					return err
+				}
+				ids = append(append([]int{}, ids...), resolved...)
 			}
+			opts = githubapp.TokenOptions{RepositoryIDs: ids, Permissions: opts.Permissions}
 		}
-		if len(tokenData.Permissions) > 0 {
-			logMsg += ", permissions:"
-			for resource, permission := range tokenData.Permissions {
-				logMsg += fmt.Sprintf(" %s:%s", resource, permission)
+
+		source = githubapp.NewInstallationTokenSource(github, app, installationID, opts)
+		source.Context = ctx
+
+		if cached {
+			log.Println(fmt.Sprintf("reusing cached token from %s", args.CacheDir))
+		} else {
+			tokenData, err = source.InstallationToken()
+			if err != nil {
+				return err
+			}
+			if cache != nil {
+				if err = cache.put(cacheKey, tokenData); err != nil {
+					log.Println(fmt.Sprintf("unable to cache token: %v", err))
+				}
 			}
 		}
-		log.Println(logMsg)
+
+		logToken(tokenData)
 	}
 
-	if args.JwtFile != "" {
-		err = os.WriteFile(args.JwtFile, []byte(jwtSigned), 0600)
+	data := outputData{
+		APIURL:       github.BaseURL,
+		App:          appData,
+		Installation: args.Installation,
+		Token:        tokenData,
+		OwnerTokens:  ownerTokens,
+	}
+	if len(policies) == 0 {
+		data.JWT, data.JWTExpiry = jwtSigned, appToken.Expiry
+	} else {
+		log.Println("the app jwt is left out of the outputs as a policy file is in effect")
+	}
+
+	// written lists what was written, for the card
+	var written []string
+	for _, o := range outputs {
+		w, err := o.Write(ctx, data)
 		if err != nil {
 			return err
 		}
+		written = append(written, w...)
 	}
 
-	if args.TokenFile != "" {
-		if args.Installation == "" {
-			log.Println("requested TOKEN_FILE but no INSTALLATION specified, skipping")
-		} else {
-			err = os.WriteFile(args.TokenFile, []byte(tokenData.Token), 0600)
+	if hasCommand(args) {
+		written = append(written, "command environment")
+	}
+
+	if args.Card.Path != "" {
+		if installation.ID == 0 && args.Installation != "" {
+			// only looked up for the card, so do not fail the step
+			installation, err = github.Installation(ctx, jwtSigned, source.InstallationID)
 			if err != nil {
-				return err
+				log.Println(fmt.Sprintf("unable to get installation details: %v", err))
 			}
 		}
+		writeCard(args.Card.Path, cardSchema, newCard(appData, installation, tokenData, cached, written))
 	}
 
-	if args.JsonFile != "" {
-		jsonData := JsonOutput{
-			Token: tokenData,
-			Jwt:   jwtSigned,
-		}
-		file, err := json.MarshalIndent(jsonData, "", " ")
+	if hasCommand(args) {
+		return runCommand(ctx, args, source, tokenData, ownerTokens)
+	}
+	return nil
+}
+
+// loadPrivateKey reads the primary app private key
+func loadPrivateKey(ctx context.Context, args Args) (*rsa.PrivateKey, error) {
+	keys, err := loadPrivateKeys(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// loadPrivateKeys reads the app private keys from the configured key source,
+// pem_files and pems_b64, decrypting them with pem_passphrase or
+// pem_passphrase_file when encrypted. The first key is the primary key, the
+// others are tried in order while a key is being rotated.
+func loadPrivateKeys(ctx context.Context, args Args) ([]*rsa.PrivateKey, error) {
+	var sources [][]byte
+	bPem, err := readKeySource(ctx, args)
+	switch {
+	case err == errNoKeySource && (len(args.PemFiles) > 0 || len(args.PemsB64) > 0):
+	case err != nil:
+		return nil, err
+	case len(bPem) == 0:
+		return nil, errors.New("unable to parse pem: private key is empty")
+	default:
+		sources = append(sources, splitPrivateKeys(bPem)...)
+	}
+
+	for _, file := range args.PemFiles {
+		data, err := os.ReadFile(file)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to read pem_files: %v", err)
 		}
-
-		err = os.WriteFile(args.JsonFile, file, 0600)
+		sources = append(sources, splitPrivateKeys(data)...)
+	}
+	for _, b64 := range args.PemsB64 {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to decode pems_b64: %v", err)
 		}
+		sources = append(sources, splitPrivateKeys(data)...)
 	}
 
-	client, hCtx := config.GetNextgenClient()
-	if args.JwtSecret != "" {
-		err = secrets.SetSecretText(hCtx, client, args.JwtSecret, args.JwtSecret, jwtSigned, args.SecretManager)
+	passphrase := []byte(args.PemPassphrase)
+	if args.PemPassphraseFile != "" {
+		passphrase, err = os.ReadFile(args.PemPassphraseFile)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("unable to read pem_passphrase_file: %v", err)
 		}
-		log.Println(fmt.Sprintf("jwt saved in %s", args.JwtSecret))
+		passphrase = []byte(strings.TrimRight(string(passphrase), "\r\n"))
 	}
-	if args.TokenSecret != "" {
-		err = secrets.SetSecretText(hCtx, client, args.TokenSecret, args.TokenSecret, tokenData.Token, args.SecretManager)
+
+	var keys []*rsa.PrivateKey
+	seen := map[string]bool{}
+	for i, source := range sources {
+		key, err := parsePrivateKey(source, passphrase)
 		if err != nil {
-			return err
+			if len(sources) > 1 {
+				return nil, fmt.Errorf("private key %d: %v", i+1, err)
+			}
+			return nil, err
+		}
+		// the same key may be listed twice while it is being rotated in
+		if fingerprint := keyFingerprint(&key.PublicKey); !seen[fingerprint] {
+			seen[fingerprint] = true
+			keys = append(keys, key)
 		}
-		log.Println(fmt.Sprintf("token saved in %s", args.TokenSecret))
 	}
-	if args.JsonSecret != "" {
-		jsonData := JsonOutput{
-			Token: tokenData,
-			Jwt:   jwtSigned,
+	return keys, nil
+}
+
+// newClient returns a github client for the configured api url
+func newClient(args Args) (*githubapp.Client, error) {
+	apiURL, err := resolveAPIURL(args)
+	if err != nil {
+		return nil, err
+	}
+	if apiURL != githubapp.DefaultAPIURL {
+		log.Println(fmt.Sprintf("using github api %s", apiURL))
+	}
+
+	return githubapp.NewClient(apiURL, githubapp.NewHTTPClient(args.HTTPTimeout, args.HTTPRetries)), nil
+}
+
+// tokenOptions builds the installation token scope from the repository
+// selection and permissions arguments
+func tokenOptions(args Args) (opts githubapp.TokenOptions, err error) {
+	opts.RepositoryIDs, opts.Repositories, err = parseRepositoryData(args)
+	if err != nil {
+		return
+	}
+
+	opts.Permissions, err = parsePermissions(args.Permissions)
+	if err != nil {
+		return
+	}
+
+	if args.LeastPrivilege {
+		opts, err = leastPrivilegeOptions(args, opts)
+	} else if len(opts.Repositories) == 0 && len(opts.RepositoryIDs) == 0 {
+		log.Println("token covers every repository of the installation, set least_privilege to scope it to this repository")
+	}
+	return
+}
+
+// leastPrivilegeOptions scopes a token without repositories to the pipeline
+// repository and allow_repos, and a token without permissions to
+// metadata:read, logging what was narrowed
+func leastPrivilegeOptions(args Args, opts githubapp.TokenOptions) (githubapp.TokenOptions, error) {
+	if len(opts.Repositories) == 0 && len(opts.RepositoryIDs) == 0 {
+		// the pipeline repository can only be in installations of its owner
+		if args.Repo.Name != "" && (args.InstallationOwner == "" || strings.EqualFold(args.InstallationOwner, args.Repo.Namespace)) {
+			opts.Repositories = append(opts.Repositories, args.Repo.Name)
 		}
-		file, err := json.MarshalIndent(jsonData, "", " ")
-		if err != nil {
-			return err
+		for _, repo := range strings.Split(args.AllowRepos, ",") {
+			repo = strings.TrimSpace(repo)
+			if repo == "" {
+				continue
+			}
+			if strings.Contains(repo, "/") {
+				return opts, fmt.Errorf("allow_repos entry '%s' should not include owner - use just the repository name", repo)
+			}
+			if !containsFold(opts.Repositories, repo) {
+				opts.Repositories = append(opts.Repositories, repo)
+			}
 		}
+		if len(opts.Repositories) == 0 {
+			return opts, errors.New("least_privilege requires allow_repos when the pipeline repository is not known or not owned by installation_owner")
+		}
+		log.Println(fmt.Sprintf("least privilege: token scoped to repositories %s instead of every repository of the installation", strings.Join(opts.Repositories, ", ")))
+	}
 
-		err = secrets.SetSecretText(hCtx, client, args.JsonSecret, args.JsonSecret, string(file), args.SecretManager)
-		if err != nil {
-			return err
+	if len(opts.Permissions) == 0 {
+		opts.Permissions = map[string]string{"metadata": "read"}
+		log.Println("least privilege: token limited to metadata:read instead of every permission of the app, set permissions to request more")
+	}
+	return opts, nil
+}
+
+// leastPrivilegeRepo reports whether least_privilege scoped the token to the
+// pipeline repository, which is only valid for installations of its owner
+func leastPrivilegeRepo(args Args, opts githubapp.TokenOptions) bool {
+	return args.LeastPrivilege && args.Repo.Name != "" &&
+		args.RepoNames == "" && args.RepoIDs == "" && args.RepoIDsFile == "" &&
+		containsFold(opts.Repositories, args.Repo.Name)
+}
+
+// leastPrivilegeInstallation drops the pipeline repository added by
+// least_privilege when the installation belongs to another owner, as github
+// refuses tokens for repositories outside the installation
+func leastPrivilegeInstallation(args Args, account string, opts githubapp.TokenOptions) (githubapp.TokenOptions, error) {
+	if !leastPrivilegeRepo(args, opts) || strings.EqualFold(account, args.Repo.Namespace) {
+		return opts, nil
+	}
+	for _, repo := range strings.Split(args.AllowRepos, ",") {
+		if strings.EqualFold(strings.TrimSpace(repo), args.Repo.Name) {
+			return opts, nil
 		}
-		log.Println(fmt.Sprintf("json saved in %s", args.JsonSecret))
 	}
-	return
+
+	var repositories []string
+	for _, repo := range opts.Repositories {
+		if !strings.EqualFold(repo, args.Repo.Name) {
+			repositories = append(repositories, repo)
+		}
+	}
+	if len(repositories) == 0 && len(opts.RepositoryIDs) == 0 {
+		return opts, fmt.Errorf("least_privilege requires allow_repos when the pipeline repository is not owned by the installation account %s", account)
+	}
+	opts.Repositories = repositories
+	log.Println(fmt.Sprintf("least privilege: %s left out of the token, installation belongs to %s", args.Repo.Name, account))
+	return opts, nil
 }
 
-// validateRepositoryArgs validates that repository selection arguments are mutually exclusive
-// and that installation is required when repository selection is used
+// validateRepositoryArgs validates that repository selection arguments are mutually exclusive,
+// that installation is required when repository selection is used and that
+// the installation lookup has an owner
 func validateRepositoryArgs(args Args) error {
 	repoArgsCount := 0
 	if args.RepoIDs != "" {
@@ -274,16 +651,79 @@ func validateRepositoryArgs(args Args) error {
 		return errors.New("only one of repo_ids, repo_names, or repo_ids_file can be specified")
 	}
 
-	if repoArgsCount > 0 && args.Installation == "" {
-		return errors.New("installation must be specified when using repository selection")
+	if owner, _ := installationLookup(args); repoArgsCount > 0 && args.Installation == "" && owner == "" {
+		return errors.New("installation, installation_owner or installation_repo must be specified when using repository selection")
+	}
+
+	// installation_repo without an owner uses the drone repository owner
+	if args.Installation == "" && args.InstallationOwner == "" && args.InstallationRepo != "" &&
+		!strings.Contains(args.InstallationRepo, "/") && args.Repo.Namespace == "" {
+		return fmt.Errorf("installation_repo '%s' has no owner and DRONE_REPO_NAMESPACE is not set - use owner/repository or set installation_owner", args.InstallationRepo)
 	}
 
 	return nil
 }
 
+// wantsToken returns true when an output or the command uses the
+// installation token
+func wantsToken(args Args) bool {
+	return args.TokenFile != "" || args.TokenSecret != "" || args.JsonFile != "" || args.JsonSecret != "" ||
+		args.EnvFile != "" || args.OutputVariables || hasCommand(args) ||
+		args.RepoIDs != "" || args.RepoNames != "" || args.RepoIDsFile != ""
+}
+
+// logToken logs the token expiry, repositories and permissions
+func logToken(tokenData githubapp.TokenResponse) {
+	logMsg := fmt.Sprintf("token received, expires %s", tokenData.ExpiresAt)
+	if len(tokenData.Repositories) > 0 {
+		logMsg += fmt.Sprintf(", repositories: %d", len(tokenData.Repositories))
+		for _, repo := range tokenData.Repositories {
+			log.Println(fmt.Sprintf("  - %s (ID: %d)", repo.Name, repo.ID))
+		}
+	}
+	if len(tokenData.Permissions) > 0 {
+		logMsg += ", permissions:"
+		for resource, permission := range tokenData.Permissions {
+			logMsg += fmt.Sprintf(" %s:%s", resource, permission)
+		}
+	}
+	log.Println(logMsg)
+}
+
+// installationLookup returns the owner and repository used to discover the
+// installation when no installation id is provided. An empty owner means no
+// lookup should be made.
+func installationLookup(args Args) (owner, repo string) {
+	switch {
+	case args.Installation != "":
+		return "", ""
+	case strings.Contains(args.InstallationRepo, "/"):
+		parts := strings.SplitN(args.InstallationRepo, "/", 2)
+		return parts[0], parts[1]
+	case args.InstallationOwner != "":
+		return args.InstallationOwner, args.InstallationRepo
+	case args.InstallationRepo != "":
+		return args.Repo.Namespace, args.InstallationRepo
+	}
+
+	// default to the current repository when a token is requested
+	if wantsToken(args) && args.Repo.Namespace != "" && args.Repo.Name != "" {
+		return args.Repo.Namespace, args.Repo.Name
+	}
+
+	// otherwise the owner of the first owner/repo name
+	for _, name := range strings.Split(args.RepoNames, ",") {
+		if parts := strings.SplitN(strings.TrimSpace(name), "/", 2); len(parts) == 2 {
+			return parts[0], parts[1]
+		}
+	}
+
+	return "", ""
+}
+
 // parseRepositoryData parses repository data from the various input sources
-// Returns a map with either "repository_ids" ([]int) or "repositories" ([]string)
-func parseRepositoryData(args Args) (map[string]interface{}, error) {
+// Returns either repository ids or repository names
+func parseRepositoryData(args Args) ([]int, []string, error) {
 	var items []string
 	useNames := false
 
@@ -295,7 +735,7 @@ func parseRepositoryData(args Args) (map[string]interface{}, error) {
 	} else if args.RepoIDsFile != "" {
 		content, err := os.ReadFile(args.RepoIDsFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read repo_ids_file: %v", err)
+			return nil, nil, fmt.Errorf("failed to read repo_ids_file: %v", err)
 		}
 		// Split by newlines and commas, filter empty strings
 		lines := strings.Split(string(content), "\n")
@@ -319,27 +759,26 @@ func parseRepositoryData(args Args) (map[string]interface{}, error) {
 	}
 
 	if len(items) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	if len(items) > 500 {
-		return nil, errors.New("repository list cannot contain more than 500 entries")
+		return nil, nil, errors.New("repository list cannot contain more than 500 entries")
 	}
 
 	if useNames {
-		// Return repository names as strings (repo name only, not owner/repo)
+		// Return repository names as strings, either repo or owner/repo
 		var repoNames []string
 		for _, name := range items {
 			name = strings.TrimSpace(name)
 			if name != "" {
-				// Validate that this is just a repo name, not owner/repo format
-				if strings.Contains(name, "/") {
-					return nil, fmt.Errorf("repository name '%s' should not include owner - use just the repository name (e.g., 'hello-world' not 'owner/hello-world')", name)
+				if parts := strings.Split(name, "/"); len(parts) > 2 || (len(parts) == 2 && (parts[0] == "" || parts[1] == "")) {
+					return nil, nil, fmt.Errorf("invalid repository name '%s' - use the repository name or owner/repository (e.g., 'hello-world' or 'octocat/hello-world')", name)
 				}
 				repoNames = append(repoNames, name)
 			}
 		}
-		return map[string]interface{}{"repositories": repoNames}, nil
+		return nil, repoNames, nil
 	} else {
 		// Convert string IDs to integers
 		var repoIDs []int
@@ -350,11 +789,11 @@ func parseRepositoryData(args Args) (map[string]interface{}, error) {
 			}
 			id, err := strconv.Atoi(idStr)
 			if err != nil {
-				return nil, fmt.Errorf("invalid repository ID '%s': %v", idStr, err)
+				return nil, nil, fmt.Errorf("invalid repository ID '%s': %v", idStr, err)
 			}
 			repoIDs = append(repoIDs, id)
 		}
-		return map[string]interface{}{"repository_ids": repoIDs}, nil
+		return repoIDs, nil, nil
 	}
 }
 
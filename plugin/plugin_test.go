@@ -4,8 +4,1761 @@
 
 package plugin
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/yaml.v3"
+)
 
 func TestPlugin(t *testing.T) {
 	t.Skip()
 }
+
+func TestResolveAPIURL(t *testing.T) {
+	tests := []struct {
+		apiURL string
+		link   string
+		hosts  []string
+		want   string
+	}{
+		{"", "", nil, "https://api.github.com"},
+		{"", "https://github.com/octocat/hello-world", nil, "https://api.github.com"},
+		{"", "https://octocorp.ghe.com/octocat/hello-world", nil, "https://api.octocorp.ghe.com"},
+		{"", "https://github.example.com/octocat/hello-world", []string{"github.example.com"}, "https://github.example.com/api/v3"},
+		// repositories on other forges use github.com unless the host is listed
+		{"", "https://github.example.com/octocat/hello-world", nil, "https://api.github.com"},
+		{"", "https://gitlab.com/octocat/hello-world", nil, "https://api.github.com"},
+		{"https://api.github.com/", "", nil, "https://api.github.com"},
+		{"octocorp.ghe.com", "", nil, "https://api.octocorp.ghe.com"},
+		{"https://api.octocorp.ghe.com", "", nil, "https://api.octocorp.ghe.com"},
+		{"https://github.example.com", "https://github.com/octocat/hello-world", nil, "https://github.example.com/api/v3"},
+		{"https://github.example.com/api/v3/", "", nil, "https://github.example.com/api/v3"},
+		{"http://localhost:8080/custom", "", nil, "http://localhost:8080/custom"},
+	}
+
+	for _, test := range tests {
+		args := Args{APIURL: test.apiURL, GitHubHosts: test.hosts}
+		args.Repo.Link = test.link
+
+		got, err := resolveAPIURL(args)
+		if err != nil {
+			t.Errorf("resolveAPIURL(%q, %q) returned error: %v", test.apiURL, test.link, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("resolveAPIURL(%q, %q) = %q, want %q", test.apiURL, test.link, got, test.want)
+		}
+	}
+
+	// the drone server host does not say where the repository is hosted
+	args := Args{GitHubHosts: []string{"drone.example.com"}}
+	args.System.Host = "drone.example.com"
+	if got, _ := resolveAPIURL(args); got != githubapp.DefaultAPIURL {
+		t.Errorf("want DRONE_SYSTEM_HOST ignored, got %q", got)
+	}
+}
+
+func TestInstallationLookup(t *testing.T) {
+	args := Args{TokenFile: "token.txt"}
+	args.Repo.Namespace = "octocat"
+	args.Repo.Name = "hello-world"
+
+	if owner, repo := installationLookup(args); owner != "octocat" || repo != "hello-world" {
+		t.Errorf("want default lookup of drone repository, got %s/%s", owner, repo)
+	}
+
+	args.InstallationRepo = "github/docs"
+	if owner, repo := installationLookup(args); owner != "github" || repo != "docs" {
+		t.Errorf("want lookup of installation_repo, got %s/%s", owner, repo)
+	}
+
+	args.Installation = "1"
+	if owner, _ := installationLookup(args); owner != "" {
+		t.Errorf("want no lookup when installation is set, got %s", owner)
+	}
+
+	// every output carrying the token looks up the drone repository
+	for _, args := range []Args{{JsonFile: "token.json"}, {JsonSecret: "token"}, {EnvFile: ".env"}, {OutputVariables: true}} {
+		args.Repo.Namespace, args.Repo.Name = "octocat", "hello-world"
+		if owner, _ := installationLookup(args); owner != "octocat" {
+			t.Errorf("want default lookup for %+v, got %q", args, owner)
+		}
+	}
+
+	args = Args{InstallationRepo: "docs"}
+	if err := validateRepositoryArgs(args); err == nil || !strings.Contains(err.Error(), "no owner") {
+		t.Errorf("want error for installation_repo without owner, got %v", err)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "output.json")
+	os.WriteFile(jsonFile, []byte(`{"token": {"token": "ghs_json"}, "jwt": "jwt"}`), 0600)
+	tokenFile := filepath.Join(dir, "token.txt")
+	os.WriteFile(tokenFile, []byte("ghs_file\n"), 0600)
+
+	ownersFile := filepath.Join(dir, "owners.json")
+	os.WriteFile(ownersFile, []byte(`{"token": {"token": "ghs_a"}, "tokens": {"other-org": {"token": "ghs_b"}, "octo-org": {"token": "ghs_a"}}}`), 0600)
+
+	tests := []struct {
+		args Args
+		want string
+	}{
+		{Args{RevokeToken: "ghs_value", TokenFile: tokenFile}, "ghs_value"},
+		{Args{TokenFile: tokenFile}, "ghs_file"},
+		{Args{JsonFile: jsonFile}, "ghs_json"},
+		{Args{RevokeTokenFile: jsonFile, TokenFile: tokenFile}, "ghs_json"},
+		{Args{JsonFile: ownersFile}, "ghs_a,ghs_b"},
+		{Args{TokenFile: filepath.Join(dir, "missing.txt")}, ""},
+	}
+
+	for _, test := range tests {
+		got, _, err := revokeTokens(test.args)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if strings.Join(got, ",") != test.want {
+			t.Errorf("want tokens %q, got %q", test.want, got)
+		}
+	}
+
+	if _, _, err := revokeTokens(Args{}); err == nil {
+		t.Errorf("want error when no token source is set")
+	}
+
+	// revoking removes the token from the cache so later steps create a new one
+	var revokedTokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revokedTokens = append(revokedTokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(dir, "cache")
+	cache := newTokenCache(cacheDir, "passphrase", time.Minute)
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	revoked := tokenCacheKey(server.URL, "Iv1.test", 1, githubapp.TokenOptions{})
+	kept := tokenCacheKey(server.URL, "Iv1.test", 2, githubapp.TokenOptions{})
+	cache.put(revoked, githubapp.TokenResponse{Token: "ghs_file", ExpiresAt: expires})
+	cache.put(kept, githubapp.TokenResponse{Token: "ghs_other", ExpiresAt: expires})
+
+	args := Args{TokenFile: tokenFile, CacheDir: cacheDir, CacheKey: "passphrase", APIURL: server.URL, HTTPTimeout: time.Second}
+	if err := revoke(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get(revoked); ok {
+		t.Errorf("want revoked token removed from the cache")
+	}
+	if _, ok := cache.get(kept); !ok {
+		t.Errorf("want other tokens kept in the cache")
+	}
+
+	// every owner token is revoked
+	revokedTokens = nil
+	args = Args{JsonFile: ownersFile, APIURL: server.URL, HTTPTimeout: time.Second}
+	if err := revoke(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(revokedTokens, ",") != "ghs_a,ghs_b" {
+		t.Errorf("want every owner token revoked, got %v", revokedTokens)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_token", "expires_at": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := githubapp.NewAppTokenSource("Iv1.test", key)
+	source := githubapp.NewInstallationTokenSource(githubapp.NewClient(server.URL, nil), app, 1, githubapp.TokenOptions{})
+
+	t.Setenv("PLUGIN_PEM_B64", "secret")
+	args := Args{Command: `test "$GITHUB_TOKEN" = ghs_token && test "$GH_TOKEN" = ghs_token && test "$(cat $GITHUB_TOKEN_FILE)" = ghs_token && test -z "$PLUGIN_PEM_B64" && exit 3`}
+
+	token, err := source.InstallationToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runCommand(context.Background(), args, source, token, nil)
+	exitErr, ok := err.(*ExitError)
+	if !ok || exitErr.Code != 3 {
+		t.Errorf("want exit code 3 from command, got %v", err)
+	}
+
+	// owner tokens are in the environment and in files that are refreshed
+	owners := []ownerToken{{Owner: "other-org", Token: githubapp.TokenResponse{Token: "ghs_other", ExpiresAt: token.ExpiresAt}, Source: source}}
+	args.Command = `test "$GITHUB_TOKEN_OTHER_ORG" = ghs_other && test "$(cat $GITHUB_TOKEN_OTHER_ORG_FILE)" = ghs_other`
+	if err = runCommand(context.Background(), args, source, token, owners); err != nil {
+		t.Errorf("want owner token variables and files, got %v", err)
+	}
+
+	// plugin settings and the credentials the plugin reads are removed
+	env := commandEnv([]string{
+		"PLUGIN_VAULT_TOKEN=s.vault", "PLUGIN_VAULT_SECRET_ID=secret", "PLUGIN_AWS_SECRET_ACCESS_KEY=aws",
+		"PLUGIN_AWS_SESSION_TOKEN=session", "PLUGIN_HARNESS_API_KEY=pat", "PLUGIN_CACHE_KEY=cache",
+		"PLUGIN_PKCS11_PIN=1234", "PLUGIN_GCP_ACCESS_TOKEN=ya29", "PLUGIN_PEM=key",
+		"HARNESS_PLATFORM_API_KEY=pat", "VAULT_TOKEN=s.vault", "AWS_SECRET_ACCESS_KEY=aws",
+		"AWS_ACCESS_KEY_ID=AKID", "GITHUB_TOKEN=old", "HOME=/root", "DRONE_REPO=octocat/hello-world",
+	}, []string{"AWS_ACCESS_KEY_ID"})
+	if strings.Join(env, " ") != "AWS_ACCESS_KEY_ID=AKID HOME=/root DRONE_REPO=octocat/hello-world" {
+		t.Errorf("want credentials removed from the command environment, got %v", env)
+	}
+}
+
+func TestGitCredential(t *testing.T) {
+	var created int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/repos/octocat/hello-world/installation":
+			w.Write([]byte(`{"id": 1, "account": {"login": "octocat"}}`))
+		case "/api/v3/app/installations/1/access_tokens":
+			created++
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token": "ghs_token", "expires_at": "` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	args := Args{
+		ClientId:           "Iv1.test",
+		Pem:                string(pemData),
+		APIURL:             server.URL,
+		CredentialCacheDir: t.TempDir(),
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	request := "protocol=http\nhost=" + host + "\npath=octocat/hello-world.git\n\n"
+
+	for i := 0; i < 2; i++ {
+		var out bytes.Buffer
+		if err := GitCredential(context.Background(), args, "get", strings.NewReader(request), &out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "username=x-access-token\npassword=ghs_token\n") {
+			t.Errorf("unexpected credential output %q", out.String())
+		}
+	}
+	if created != 1 {
+		t.Errorf("want cached token reused, created %d tokens", created)
+	}
+
+	if err := GitCredential(context.Background(), args, "erase", strings.NewReader(request), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := GitCredential(context.Background(), args, "get", strings.NewReader(request), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if created != 2 {
+		t.Errorf("want new token after erase, created %d tokens", created)
+	}
+
+	// the policy limits the helper like any other token, and a token cached
+	// without the policy is not reused
+	defer func(file string) { defaultPolicyFile = file }(defaultPolicyFile)
+	defaultPolicyFile = filepath.Join(args.CredentialCacheDir, "missing.yaml")
+	args.PolicyFile = filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(args.PolicyFile, []byte("rules:\n- name: read only\n  permissions: {contents: read}\n"), 0600)
+	args.Permissions = "contents:write"
+	if err := GitCredential(context.Background(), args, "get", strings.NewReader(request), io.Discard); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Errorf("want policy enforced by the credential helper, got %v", err)
+	}
+	args.Permissions = ""
+	if err := GitCredential(context.Background(), args, "get", strings.NewReader(request), io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if created != 3 {
+		t.Errorf("want new token scoped by the policy, created %d tokens", created)
+	}
+	args.PolicyFile = ""
+
+	var out bytes.Buffer
+	other := "protocol=https\nhost=gitlab.com\npath=octocat/hello-world.git\n\n"
+	if err := GitCredential(context.Background(), args, "get", strings.NewReader(other), &out); err != nil || out.Len() != 0 {
+		t.Errorf("want no credential for other hosts, got %q, %v", out.String(), err)
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	dir := t.TempDir()
+	opts := githubapp.TokenOptions{Repositories: []string{"b", "a"}, Permissions: map[string]string{"contents": "read"}}
+	key := tokenCacheKey(githubapp.DefaultAPIURL, "Iv1.test", 1, opts)
+
+	reordered := githubapp.TokenOptions{Repositories: []string{"a", "b"}, Permissions: map[string]string{"contents": "read"}}
+	if key != tokenCacheKey(githubapp.DefaultAPIURL, "Iv1.test", 1, reordered) {
+		t.Errorf("want cache key independent of repository order")
+	}
+
+	cache := newTokenCache(dir, "passphrase", 10*time.Minute)
+	fresh := githubapp.TokenResponse{Token: "ghs_fresh", ExpiresAt: time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}
+	if err := cache.put(key, fresh); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(cache.path(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("want cache file mode 0600, got %v", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(cache.path(key)); strings.Contains(string(data), "ghs_fresh") {
+		t.Errorf("want encrypted cache entry")
+	}
+
+	if token, ok := cache.get(key); !ok || token.Token != "ghs_fresh" {
+		t.Errorf("want cached token, got %v %v", token.Token, ok)
+	}
+
+	// every entry is encrypted with its own salt
+	first, _ := os.ReadFile(cache.path(key))
+	if err := cache.put(key, fresh); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := os.ReadFile(cache.path(key))
+	var firstEntry, secondEntry encryptedEntry
+	json.Unmarshal(first, &firstEntry)
+	json.Unmarshal(second, &secondEntry)
+	if len(firstEntry.Salt) != 16 || bytes.Equal(firstEntry.Salt, secondEntry.Salt) {
+		t.Errorf("want a random salt per cache entry, got %x and %x", firstEntry.Salt, secondEntry.Salt)
+	}
+	if _, ok := newTokenCache(dir, "wrong", 10*time.Minute).get(key); ok {
+		t.Errorf("want cache miss with the wrong passphrase")
+	}
+	if _, ok := newTokenCache(dir, "passphrase", 2*time.Hour).get(key); ok {
+		t.Errorf("want cache miss when the token does not have the minimum lifetime left")
+	}
+}
+
+func TestFormatEnv(t *testing.T) {
+	vars := []envVar{
+		{Name: "GITHUB_TOKEN", Value: "ghs_token"},
+		{Name: "GITHUB_TOKEN_PERMISSIONS", Value: "contents:read,issues:write"},
+		{Name: "GITHUB_TOKEN_REPOSITORIES", Value: ""},
+		{Name: "QUOTED", Value: `it's "$HOME"`},
+	}
+
+	dotenv, err := formatEnv(vars, "dotenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "GITHUB_TOKEN=ghs_token\nGITHUB_TOKEN_PERMISSIONS=contents:read,issues:write\nGITHUB_TOKEN_REPOSITORIES=\"\"\nQUOTED=\"it's \\\"\\$HOME\\\"\"\n"
+	if string(dotenv) != want {
+		t.Errorf("unexpected dotenv output\n%s\nwant\n%s", dotenv, want)
+	}
+
+	export, err := formatEnv(vars, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "export GITHUB_TOKEN='ghs_token'\nexport GITHUB_TOKEN_PERMISSIONS='contents:read,issues:write'\nexport GITHUB_TOKEN_REPOSITORIES=''\nexport QUOTED='it'\\''s \"$HOME\"'\n"
+	if string(export) != want {
+		t.Errorf("unexpected export output\n%s\nwant\n%s", export, want)
+	}
+
+	if _, err = formatEnv(vars, "yaml"); err == nil {
+		t.Errorf("want error for unknown format")
+	}
+
+	// secrets are not written as plain step outputs without a secret file
+	dir := t.TempDir()
+	outputs := []envVar{{Name: "GITHUB_APP_SLUG", Value: "octo-app"}, {Name: "GITHUB_TOKEN", Value: "ghs_token", Secret: true}}
+	outputFile, secretFile := filepath.Join(dir, "output"), filepath.Join(dir, "secret")
+	if err = writeOutputVariables(outputFile, "", false, outputs); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(outputFile); string(data) != "GITHUB_APP_SLUG=octo-app\n" {
+		t.Errorf("want token left out of plain outputs, got %q", data)
+	}
+	if err = writeOutputVariables(outputFile, secretFile, false, outputs); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(secretFile); string(data) != "GITHUB_TOKEN=ghs_token\n" {
+		t.Errorf("want token in the secret outputs, got %q", data)
+	}
+	os.Remove(outputFile)
+	if err = writeOutputVariables(outputFile, "", true, outputs); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(outputFile); !strings.Contains(string(data), "GITHUB_TOKEN=ghs_token") {
+		t.Errorf("want token in plain outputs with output_plain_secrets, got %q", data)
+	}
+}
+
+func TestNewCard(t *testing.T) {
+	app := githubapp.AppResponse{ID: 1, Slug: "octo-app"}
+	installation := githubapp.InstallationResponse{ID: 31437931}
+	installation.Account.Login = "octocat"
+	token := githubapp.TokenResponse{
+		Token:               "ghs_secret",
+		ExpiresAt:           "2016-07-11T22:14:10Z",
+		Permissions:         map[string]string{"issues": "write", "contents": "read"},
+		RepositorySelection: "selected",
+		Repositories:        []githubapp.TokenResponseRepository{{ID: 1296269, Name: "Hello-World"}},
+	}
+
+	card := newCard(app, installation, token, false, []string{"token file github_token.txt"})
+	if card.Installation != "31437931" || card.Account != "octocat" || len(card.Repositories) != 1 {
+		t.Errorf("unexpected card %+v", card)
+	}
+	if card.Permissions[0].Resource != "contents" {
+		t.Errorf("want permissions sorted by resource, got %+v", card.Permissions)
+	}
+
+	data, _ := json.Marshal(card)
+	if strings.Contains(string(data), "ghs_secret") {
+		t.Errorf("card must not include the token")
+	}
+}
+
+func TestVaultSink(t *testing.T) {
+	requests := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/approle/login" {
+			w.Write([]byte(`{"auth":{"client_token":"s.login"}}`))
+			return
+		}
+		if r.Header.Get("X-Vault-Token") != "s.login" || r.Header.Get("X-Vault-Namespace") != "team" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests[r.URL.Path] = body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	args := Args{
+		VaultAddr:       server.URL,
+		VaultNamespace:  "team",
+		VaultMount:      "secret",
+		VaultKVVersion:  2,
+		VaultField:      "value",
+		VaultAuthMethod: "approle",
+		VaultRoleID:     "role",
+		VaultSecretID:   "secret",
+	}
+	sink, err := newVaultSink(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	if err = sink.Store(context.Background(), Secret{ID: "ci/token", Kind: "token", Value: "ghs_token", ExpiresAt: expiry}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := requests["/v1/secret/data/ci/token"]["data"].(map[string]interface{})
+	if data["value"] != "ghs_token" || data["expires_at"] != expiry.UTC().Format(time.RFC3339) {
+		t.Errorf("want token and expiry written to kv v2 data, got %v", requests["/v1/secret/data/ci/token"])
+	}
+	metadata := requests["/v1/secret/metadata/ci/token"]
+	if custom, _ := metadata["custom_metadata"].(map[string]interface{}); custom["kind"] != "token" {
+		t.Errorf("want kind in custom metadata, got %v", metadata)
+	}
+	if metadata["delete_version_after"] == nil {
+		t.Errorf("want delete_version_after set from the expiry")
+	}
+
+	args.VaultKVVersion = 1
+	args.VaultAuthMethod = "token"
+	args.VaultToken = "s.login"
+	sink, err = newVaultSink(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Store(context.Background(), Secret{ID: "ci/jwt", Kind: "jwt", Value: "jwt"}); err != nil {
+		t.Fatal(err)
+	}
+	if requests["/v1/secret/ci/jwt"]["value"] != "jwt" {
+		t.Errorf("want value written to kv v1 path, got %v", requests["/v1/secret/ci/jwt"])
+	}
+
+	args.VaultToken = "s.wrong"
+	sink, _ = newVaultSink(context.Background(), args)
+	if err = sink.Store(context.Background(), Secret{ID: "ci/jwt", Value: "jwt"}); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("want vault error surfaced, got %v", err)
+	}
+}
+
+func TestKubernetesSink(t *testing.T) {
+	secrets := map[string]map[string]interface{}{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kube-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case r.Method == "PATCH" && secrets[r.URL.Path] == nil:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"secrets \"github\" not found"}`))
+		case r.Method == "PATCH":
+			data := secrets[r.URL.Path]["data"].(map[string]interface{})
+			for k, v := range body["data"].(map[string]interface{}) {
+				data[k] = v
+			}
+			w.Write([]byte(`{}`))
+		case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/deploy/secrets":
+			secrets[r.URL.Path+"/github"] = body
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: ci
+contexts:
+- name: ci
+  context: {cluster: ci, user: ci, namespace: deploy}
+clusters:
+- name: ci
+  cluster:
+    server: `+server.URL+`
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+users:
+- name: ci
+  user: {token: kube-token}
+`), 0600)
+
+	args := Args{
+		Kubeconfig:   kubeconfig,
+		KubeTokenKey: "password",
+		KubeJwtKey:   "jwt",
+		KubeLabels:   "team=platform",
+	}
+	sink, err := newKubernetesSink(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	if err = sink.Store(context.Background(), Secret{ID: "github", Kind: "token", Value: "ghs_token", ExpiresAt: expiry}); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Store(context.Background(), Secret{ID: "github", Kind: "jwt", Value: "jwt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	created := secrets["/api/v1/namespaces/deploy/secrets/github"]
+	metadata := created["metadata"].(map[string]interface{})
+	if labels := metadata["labels"].(map[string]interface{}); labels["team"] != "platform" {
+		t.Errorf("want labels set, got %v", labels)
+	}
+	if annotations := metadata["annotations"].(map[string]interface{}); annotations["drone-github-app/token-expires-at"] != expiry.UTC().Format(time.RFC3339) {
+		t.Errorf("want expiry annotation, got %v", annotations)
+	}
+	data := created["data"].(map[string]interface{})
+	if data["password"] != base64.StdEncoding.EncodeToString([]byte("ghs_token")) || data["jwt"] != base64.StdEncoding.EncodeToString([]byte("jwt")) {
+		t.Errorf("want token and jwt keys in the secret, got %v", data)
+	}
+
+	manifest := filepath.Join(t.TempDir(), "secret.yaml")
+	sink, err = newKubernetesSink(Args{KubeManifestFile: manifest, KubeNamespace: "deploy", KubeTokenKey: "token", KubeJwtKey: "jwt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Store(context.Background(), Secret{ID: "github", Kind: "token", Value: "ghs_token"})
+	sink.Store(context.Background(), Secret{ID: "github", Kind: "jwt", Value: "jwt"})
+	out, _ := os.ReadFile(manifest)
+	if strings.Count(string(out), "kind: Secret") != 1 || !strings.Contains(string(out), "token: "+base64.StdEncoding.EncodeToString([]byte("ghs_token"))) || !strings.Contains(string(out), "namespace: deploy") {
+		t.Errorf("want a single secret manifest with both keys, got\n%s", out)
+	}
+
+	// image pull secrets hold the token as registry credentials
+	sink, err = newKubernetesSink(Args{KubeManifestFile: manifest, KubeSecretType: kubeDockerConfigJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Store(context.Background(), Secret{ID: "ghcr", Kind: "token", Value: "ghs_token"}); err != nil {
+		t.Fatal(err)
+	}
+	pull := kubeSecret{}
+	out, _ = os.ReadFile(manifest)
+	yaml.Unmarshal(out, &pull)
+	config, _ := base64.StdEncoding.DecodeString(pull.Data[".dockerconfigjson"])
+	auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:ghs_token"))
+	if pull.Type != kubeDockerConfigJSON || string(config) != `{"auths":{"ghcr.io":{"auth":"`+auth+`","password":"ghs_token","username":"x-access-token"}}}` {
+		t.Errorf("want dockerconfigjson secret, got %s %s", pull.Type, config)
+	}
+	if err = sink.Store(context.Background(), Secret{ID: "ghcr", Kind: "jwt", Value: "jwt"}); err == nil {
+		t.Errorf("want error storing the jwt in a dockerconfigjson secret")
+	}
+	if _, err = newKubernetesSink(Args{KubeManifestFile: manifest, KubeSecretType: "kubernetes.io/tls"}); err == nil {
+		t.Errorf("want error for unsupported secret types")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	// exec credential plugins, like aws eks get-token, provide the token
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "get-token"), []byte(`#!/bin/sh
+echo "$KUBERNETES_EXEC_INFO" | grep -q '"kind":"ExecCredential"' || exit 1
+echo '{"apiVersion": "client.authentication.k8s.io/v1", "kind": "ExecCredential", "status": {"token": "'$TOKEN'"}}'
+`), 0700)
+	os.WriteFile(filepath.Join(dir, "config"), []byte(`
+current-context: ci
+contexts:
+- name: ci
+  context: {cluster: ci, user: ci, namespace: deploy}
+clusters:
+- name: ci
+  cluster:
+    server: `+server.URL+`
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+users:
+- name: ci
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: ./get-token
+      env: [{name: TOKEN, value: kube-token}]
+      provideClusterInfo: true
+      interactiveMode: Never
+`), 0600)
+	sink, err = newKubernetesSink(Args{Kubeconfig: filepath.Join(dir, "config")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Store(context.Background(), Secret{ID: "github", Kind: "token", Value: "ghs_exec"}); err != nil {
+		t.Errorf("want secret stored with the exec plugin token, got %v", err)
+	}
+}
+
+func TestAWSSinks(t *testing.T) {
+	var actions []string
+	bodies := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		action := r.Header.Get("X-Amz-Target")
+		actions = append(actions, action)
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies[action] = body
+		if action == "secretsmanager.CreateSecret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceExistsException","message":"the secret github-token already exists"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	args := Args{
+		AWSRegion:          "us-east-1",
+		AWSEndpoint:        server.URL,
+		AWSAccessKeyID:     "AKID",
+		AWSSecretAccessKey: "secret",
+		AWSKMSKeyID:        "alias/ci",
+		AWSTags:            "team=platform",
+	}
+	secret := Secret{ID: "github-token", Kind: "token", Value: "ghs_token", ExpiresAt: time.Now().Add(time.Hour)}
+
+	secretsManager, err := newSecretsManagerSink(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = secretsManager.Store(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(actions, ",") != "secretsmanager.CreateSecret,secretsmanager.UpdateSecret,secretsmanager.TagResource" {
+		t.Errorf("want existing secret updated, got %v", actions)
+	}
+	if update := bodies["secretsmanager.UpdateSecret"]; update["SecretString"] != "ghs_token" || update["KmsKeyId"] != "alias/ci" {
+		t.Errorf("want value and kms key updated, got %v", update)
+	}
+
+	actions = nil
+	ssm, err := newSSMSink(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ssm.Store(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if put := bodies["AmazonSSM.PutParameter"]; put["Type"] != "SecureString" || put["Overwrite"] != true || put["KeyId"] != "alias/ci" {
+		t.Errorf("want secure string parameter, got %v", put)
+	}
+	if tags, _ := bodies["AmazonSSM.AddTagsToResource"]["Tags"].([]interface{}); len(tags) != 3 {
+		t.Errorf("want team, kind and expiry tags, got %v", tags)
+	}
+}
+
+func TestHarnessSink(t *testing.T) {
+	var requests []string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "pat.test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		requests = append(requests, fmt.Sprintf("%s %s %s/%s", r.Method, r.URL.Path, q.Get("orgIdentifier"), q.Get("projectIdentifier")))
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" && r.URL.Path == "/ng/api/v2/secrets/new_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"ERROR","code":"RESOURCE_NOT_FOUND_EXCEPTION","message":"Secret with identifier [new_token] does not exist"}`))
+			return
+		}
+		if r.Method != "GET" {
+			body = map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+		w.Write([]byte(`{"status":"SUCCESS"}`))
+	}))
+	defer server.Close()
+
+	args := Args{
+		HarnessAPIKey:    "pat.test",
+		HarnessAccountID: "account",
+		HarnessEndpoint:  server.URL,
+		HarnessOrg:       "default",
+		HarnessProject:   "ci",
+		SecretScope:      "org",
+		SecretTags:       "owner=platform",
+		SecretWriteMode:  "upsert",
+	}
+	sink, err := newHarnessSink(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := Secret{ID: "new_token", Kind: "token", Value: "ghs_token", App: "octoapp", Installation: "42", ExpiresAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err = sink.Store(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET /ng/api/v2/secrets/new_token default/,POST /ng/api/v2/secrets default/"; strings.Join(requests, ",") != want {
+		t.Errorf("want missing org secret created, got %v", requests)
+	}
+	created, _ := body["secret"].(map[string]interface{})
+	if created["description"] != "github app octoapp token for installation 42, expires 2030-01-01T00:00:00Z" || created["orgIdentifier"] != "default" || created["projectIdentifier"] != nil {
+		t.Errorf("want org scoped secret with description, got %v", created)
+	}
+	if tags, _ := created["tags"].(map[string]interface{}); tags["owner"] != "platform" {
+		t.Errorf("want tags, got %v", created["tags"])
+	}
+
+	requests = nil
+	secret.ID = "existing_token"
+	if err = sink.Store(context.Background(), secret); err != nil {
+		t.Fatal(err)
+	}
+	if want := "GET /ng/api/v2/secrets/existing_token default/,PUT /ng/api/v2/secrets/existing_token default/"; strings.Join(requests, ",") != want {
+		t.Errorf("want existing secret updated, got %v", requests)
+	}
+
+	args.SecretWriteMode = "update"
+	sink, _ = newHarnessSink(args)
+	secret.ID = "new_token"
+	if err = sink.Store(context.Background(), secret); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("want update of a missing secret to fail, got %v", err)
+	}
+
+	args.SecretScope = "project"
+	args.HarnessOrg = ""
+	if _, err = newHarnessSink(args); err == nil {
+		t.Errorf("want project scope without an org to fail")
+	}
+}
+
+func TestOutputsValidatedFirst(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("HARNESS_PLATFORM_API_KEY", "")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	args := Args{ClientId: "Iv1.test", Pem: string(pemData), APIURL: server.URL, TokenSecret: "token"}
+	for _, sink := range []string{"harness", "vault", "unknown"} {
+		args.SecretSink = sink
+		if err = Exec(context.Background(), args); err == nil {
+			t.Errorf("want misconfigured %s sink to fail", sink)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("want no github requests before outputs are validated, got %d", requests)
+	}
+
+	outputs, err := newOutputs(context.Background(), Args{JwtFile: "jwt.txt", EnvFile: ".env", EnvFormat: "dotenv"})
+	if err != nil || len(outputs) != 2 {
+		t.Errorf("want file outputs without secret sink settings, got %d, %v", len(outputs), err)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	// legacy encrypted pem, as written by openssl rsa -aes256
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("drone"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := pem.EncodeToMemory(block)
+
+	for name, data := range map[string][]byte{"pkcs1": pkcs1, "pkcs8": pkcs8, "legacy encrypted": legacy} {
+		parsed, err := parsePrivateKey(data, []byte("drone"))
+		if err != nil || !parsed.Equal(key) {
+			t.Errorf("want %s key parsed, got %v", name, err)
+		}
+	}
+
+	// encrypted with openssl pkcs8 -topk8 -v2 <cipher> -v2prf <prf>
+	for _, file := range []string{"testdata/pkcs8-aes256.pem", "testdata/pkcs8-des3.pem"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = parsePrivateKey(data, []byte("drone")); err != nil {
+			t.Errorf("want %s decrypted, got %v", file, err)
+		}
+		if _, err = parsePrivateKey(data, []byte("wrong")); err == nil {
+			t.Errorf("want wrong passphrase for %s to fail", file)
+		}
+		if _, err = parsePrivateKey(data, nil); err == nil || !strings.Contains(err.Error(), "pem_passphrase") {
+			t.Errorf("want missing passphrase error for %s, got %v", file, err)
+		}
+	}
+
+	// iteration counts from the key file are bounded
+	data, err := os.ReadFile("testdata/pkcs8-aes256.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBlock, _ := pem.Decode(data)
+	for _, count := range []int{0, maxPBKDF2Iterations + 1} {
+		var info encryptedPrivateKeyInfo
+		var params pbes2Params
+		var kdf pbkdf2Params
+		asn1.Unmarshal(pemBlock.Bytes, &info)
+		asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+		asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+		kdf.IterationCount = count
+		params.KeyDerivationFunc.Parameters.FullBytes, _ = asn1.Marshal(kdf)
+		info.Algorithm.Parameters.FullBytes, _ = asn1.Marshal(params)
+		der, _ := asn1.Marshal(info)
+		crafted := pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der})
+		if _, err := parsePrivateKey(crafted, []byte("drone")); err == nil || !strings.Contains(err.Error(), "iteration count") {
+			t.Errorf("want iteration count %d to be rejected, got %v", count, err)
+		}
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	publicDER, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	for name, data := range map[string][]byte{
+		"ecdsa":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}),
+		"public": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}),
+		"empty":  []byte("not a pem"),
+	} {
+		if _, err := parsePrivateKey(data, nil); err == nil {
+			t.Errorf("want %s key to be rejected", name)
+		}
+	}
+}
+
+func TestKeySources(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/ci/github-app" || r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		data, _ := json.Marshal(map[string]interface{}{"data": map[string]interface{}{"data": map[string]string{
+			"pem": string(pkcs1),
+			"b64": base64.StdEncoding.EncodeToString(pkcs1),
+		}}})
+		w.Write(data)
+	}))
+	defer vault.Close()
+
+	kube := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/ci/secrets/github-app" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data":{"pem":"` + base64.StdEncoding.EncodeToString(pkcs1) + `"}}`))
+	}))
+	defer kube.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kube.Certificate().Raw})
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	os.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: ci
+contexts:
+- name: ci
+  context: {cluster: ci, user: ci, namespace: deploy}
+clusters:
+- name: ci
+  cluster:
+    server: `+kube.URL+`
+    certificate-authority-data: `+base64.StdEncoding.EncodeToString(ca)+`
+users:
+- name: ci
+  user: {token: kube-token}
+`), 0600)
+
+	pemFile := filepath.Join(t.TempDir(), "app.pem")
+	os.WriteFile(pemFile, pkcs1, 0600)
+
+	vaultArgs := Args{VaultAddr: vault.URL, VaultToken: "s.token", VaultMount: "secret", VaultKVVersion: 2, VaultField: "pem"}
+	for name, args := range map[string]Args{
+		"vault":          func() Args { a := vaultArgs; a.PemVault = "ci/github-app"; return a }(),
+		"vault base64":   func() Args { a := vaultArgs; a.PemVault = "ci/github-app#b64"; return a }(),
+		"kubernetes":     {Kubeconfig: kubeconfig, PemKubernetes: "ci/github-app"},
+		"command":        {PemCommand: "cat " + pemFile},
+		"command base64": {PemCommand: "base64 < " + pemFile},
+	} {
+		parsed, err := loadPrivateKey(context.Background(), args)
+		if err != nil || !parsed.Equal(key) {
+			t.Errorf("want %s key loaded, got %v", name, err)
+		}
+	}
+
+	for name, args := range map[string]Args{
+		"vault missing field": func() Args { a := vaultArgs; a.PemVault = "ci/github-app#missing"; return a }(),
+		"kubernetes missing":  {Kubeconfig: kubeconfig, PemKubernetes: "github-app"},
+		"command failing":     {PemCommand: "echo denied >&2; exit 1"},
+		"none":                {},
+	} {
+		if _, err := loadPrivateKey(context.Background(), args); err == nil {
+			t.Errorf("want %s to fail", name)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	oldPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(oldKey)})
+	newPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(newKey)})
+
+	pemFile := filepath.Join(t.TempDir(), "old.pem")
+	os.WriteFile(pemFile, oldPem, 0600)
+
+	for name, args := range map[string]Args{
+		"concatenated": {Pem: string(newPem) + string(oldPem)},
+		"pem_files":    {Pem: string(newPem), PemFiles: []string{pemFile}},
+		"pems_b64":     {PemsB64: []string{base64.StdEncoding.EncodeToString(newPem), base64.StdEncoding.EncodeToString(oldPem)}},
+		"duplicates":   {Pem: string(newPem), PemsB64: []string{base64.StdEncoding.EncodeToString(newPem)}, PemFiles: []string{pemFile}},
+	} {
+		keys, err := loadPrivateKeys(context.Background(), args)
+		if err != nil || len(keys) != 2 || !keys[0].Equal(newKey) || !keys[1].Equal(oldKey) {
+			t.Errorf("want %s to load the new and old key in order, got %d keys, %v", name, len(keys), err)
+		}
+	}
+
+	// github only knows the old key, as the new key is not uploaded yet
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&oldKey.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"A JSON web token could not be decoded"}`))
+			return
+		}
+		w.Write([]byte(`{"id":1,"slug":"drone"}`))
+	}))
+	defer server.Close()
+
+	github := githubapp.NewClient(server.URL, nil)
+	_, _, app, err := authenticateApp(context.Background(), github, "Iv1.test", []crypto.Signer{newKey, oldKey})
+	if err != nil || app.Slug != "drone" {
+		t.Errorf("want fallback to the old key, got %v", err)
+	}
+	if _, _, _, err = authenticateApp(context.Background(), github, "Iv1.test", []crypto.Signer{newKey}); !githubapp.IsUnauthorized(err) {
+		t.Errorf("want 401 when no key is accepted, got %v", err)
+	}
+}
+
+func TestBroker(t *testing.T) {
+	var created, lookups int
+	var uninstalled bool
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := strings.TrimPrefix(r.URL.Path, "/api/v3"); {
+		case path == "/app":
+			w.Write([]byte(`{"id":1,"slug":"drone"}`))
+		case (path == "/orgs/octo-org/installation" || path == "/app/installations/1") && !uninstalled:
+			lookups++
+			w.Write([]byte(`{"id":1,"account":{"login":"octo-org"}}`))
+		case path == "/app/installations/1/access_tokens" && !uninstalled:
+			created++
+			opts := githubapp.TokenOptions{}
+			json.NewDecoder(r.Body).Decode(&opts)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(githubapp.TokenResponse{
+				Token:       fmt.Sprintf("ghs_%d", created),
+				ExpiresAt:   time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+				Permissions: opts.Permissions,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Not Found"}`))
+		}
+	}))
+	defer github.Close()
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return fmt.Sprintf("%x", sum)
+	}
+	callers := filepath.Join(t.TempDir(), "callers.yaml")
+	os.WriteFile(callers, []byte(`
+callers:
+- name: frontend
+  token_sha256: `+hash("frontend-token")+`
+  owners: [Octo-Org]
+  repositories: [web]
+  permissions: {contents: read, pull_requests: write}
+- name: expired
+  token_sha256: `+hash("expired-token")+`
+  expires_at: 2020-01-01T00:00:00Z
+  installations: [1]
+`), 0600)
+
+	b, err := newBroker(context.Background(), Args{
+		ClientId:         "Iv1.test",
+		Pem:              string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		APIURL:           github.URL,
+		ServeCallersFile: callers,
+		CacheMinLifetime: 10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := b.handler()
+
+	request := func(token, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		resp := map[string]interface{}{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, resp := request("frontend-token", `{"owner":"octo-org"}`)
+	if code != http.StatusOK || resp["token"] != "ghs_1" {
+		t.Fatalf("want token for the caller, got %d %v", code, resp)
+	}
+	if permissions, _ := resp["permissions"].(map[string]interface{}); permissions["pull_requests"] != "write" {
+		t.Errorf("want the caller's permissions by default, got %v", resp["permissions"])
+	}
+	if code, resp = request("frontend-token", `{"installation":1}`); code != http.StatusOK || resp["token"] != "ghs_1" {
+		t.Errorf("want cached token for the same scope, got %d %v", code, resp)
+	}
+	if code, _ = request("frontend-token", `{"owner":"octo-org","permissions":{"contents":"read"}}`); code != http.StatusOK || created != 2 {
+		t.Errorf("want a new token for a narrower scope, got %d after %d tokens", code, created)
+	}
+
+	for name, test := range map[string]struct {
+		token, body string
+		code        int
+	}{
+		"unknown token":      {"wrong", `{"installation":1}`, http.StatusUnauthorized},
+		"expired caller":     {"expired-token", `{"installation":1}`, http.StatusUnauthorized},
+		"other repository":   {"frontend-token", `{"installation":1,"repositories":["api"]}`, http.StatusForbidden},
+		"other owner":        {"frontend-token", `{"installation":1,"repositories":["other-org/web"]}`, http.StatusForbidden},
+		"higher permission":  {"frontend-token", `{"installation":1,"permissions":{"contents":"write"}}`, http.StatusForbidden},
+		"other installation": {"frontend-token", `{"owner":"other"}`, http.StatusNotFound},
+		"invalid request":    {"frontend-token", `{"installation":"1"}`, http.StatusBadRequest},
+	} {
+		if code, resp := request(test.token, test.body); code != test.code {
+			t.Errorf("want %d for %s, got %d %v", test.code, name, code, resp)
+		}
+	}
+
+	// installation lookups are reused until they expire
+	before := lookups
+	request("frontend-token", `{"owner":"octo-org","permissions":{"pull_requests":"read"}}`)
+	if lookups != before {
+		t.Errorf("want the cached installation reused, got %d lookups", lookups-before)
+	}
+	now := time.Now()
+	b.now = func() time.Time { return now.Add(installationCacheTTL + time.Minute) }
+	request("frontend-token", `{"owner":"octo-org","permissions":{"pull_requests":"read"}}`)
+	if lookups != before+1 {
+		t.Errorf("want the installation looked up again after it expired, got %d lookups", lookups-before)
+	}
+
+	// an uninstalled app drops the cached installation
+	uninstalled = true
+	if code, resp := request("frontend-token", `{"owner":"octo-org","permissions":{"contents":"read","pull_requests":"read"}}`); code != http.StatusNotFound {
+		t.Errorf("want 404 once the app is uninstalled, got %d %v", code, resp)
+	}
+	if len(b.installations) != 0 {
+		t.Errorf("want the installation dropped from the cache, got %v", b.installations)
+	}
+	if code, _ := request("frontend-token", `{"owner":"octo-org"}`); code != http.StatusNotFound {
+		t.Errorf("want the installation looked up again, got %d", code)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/v3") {
+		case "/app":
+			w.Write([]byte(`{"id":1,"slug":"drone"}`))
+		case "/repos/octo-org/web/installation":
+			w.Write([]byte(`{"id":7,"account":{"login":"octo-org"}}`))
+		case "/app/installations/7/access_tokens":
+			opts := githubapp.TokenOptions{}
+			json.NewDecoder(r.Body).Decode(&opts)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(githubapp.TokenResponse{
+				Token:       "ghs_oidc",
+				ExpiresAt:   time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+				Permissions: opts.Permissions,
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer github.Close()
+
+	issuerKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "ci",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(issuerKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuerKey.E)).Bytes()),
+	}}})
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			w.Write([]byte(`{"jwks_uri":"` + issuer.URL + `/keys"}`))
+		case "/keys":
+			w.Write(jwks)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer issuer.Close()
+
+	idToken := func(claims jwt.MapClaims) string {
+		claims["iss"] = issuer.URL
+		claims["exp"] = time.Now().Add(5 * time.Minute).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "ci"
+		signed, _ := token.SignedString(issuerKey)
+		return signed
+	}
+
+	rules := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(rules, []byte(`
+rules:
+- name: web-main
+  claims:
+    repo: octo-org/web
+    branch: [main, release/*]
+    event: push
+  owners: [octo-org]
+  repositories: [web]
+  permissions: {contents: write}
+`), 0600)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	brokerArgs := Args{
+		ClientId:      "Iv1.test",
+		Pem:           string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		APIURL:        github.URL,
+		OIDCIssuer:    issuer.URL,
+		OIDCAudience:  "github-app-broker",
+		OIDCRulesFile: rules,
+	}
+	b, err := newBroker(context.Background(), brokerArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(b.handler())
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	args := Args{
+		BrokerURL: server.URL,
+		OIDCToken: idToken(jwt.MapClaims{"aud": "github-app-broker", "sub": "repo:octo-org/web", "repo": "octo-org/web", "branch": "release/1.0", "event": "push"}),
+		TokenFile: tokenFile,
+		APIURL:    github.URL,
+	}
+	args.Repo.Namespace, args.Repo.Name = "octo-org", "web"
+	if err = Exec(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(tokenFile); string(data) != "ghs_oidc" {
+		t.Errorf("want token from the broker written, got %q", data)
+	}
+
+	for name, claims := range map[string]jwt.MapClaims{
+		"other branch":   {"aud": "github-app-broker", "repo": "octo-org/web", "branch": "feature", "event": "push"},
+		"other audience": {"aud": "sts.amazonaws.com", "repo": "octo-org/web", "branch": "main", "event": "push"},
+	} {
+		args.OIDCToken = idToken(claims)
+		if err = Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "broker returned") {
+			t.Errorf("want %s to be refused, got %v", name, err)
+		}
+	}
+	args.OIDCToken = idToken(jwt.MapClaims{"aud": "github-app-broker", "repo": "octo-org/web", "branch": "main", "event": "push"})
+	args.Permissions = "administration:write"
+	if err = Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("want permissions above the rule refused, got %v", err)
+	}
+
+	// a local jwks file verifies tokens without the issuer
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, jwks, 0600)
+	verifier, err := newOIDCVerifier(Args{OIDCIssuer: issuer.URL, OIDCAudience: "github-app-broker", OIDCJWKSFile: jwksFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Close()
+	if claims, err := verifier.Verify(context.Background(), args.OIDCToken); err != nil || claims["branch"] != "main" {
+		t.Errorf("want token verified with the jwks file, got %v", err)
+	}
+}
+
+func TestOIDCVerifierKeys(t *testing.T) {
+	issuerKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "ci",
+		"n":   base64.RawURLEncoding.EncodeToString(issuerKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuerKey.E)).Bytes()),
+	}}})
+	var fetches int32
+	var failing atomic.Bool
+	release := make(chan struct{})
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(jwks)
+	}))
+	defer issuer.Close()
+
+	verifier, err := newOIDCVerifier(Args{OIDCIssuer: issuer.URL, OIDCAudience: "github-app-broker", OIDCJWKSURL: issuer.URL + "/keys"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent requests share one fetch
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.key(context.Background(), "ci")
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("want key, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("want the keys fetched once, got %d", n)
+	}
+
+	// a failed refresh keeps the cached keys until they expire
+	failing.Store(true)
+	verifier.fetched = time.Now().Add(-jwksRefreshAfter - time.Minute)
+	verifier.attempted = time.Time{}
+	if _, err = verifier.key(context.Background(), "ci"); err != nil {
+		t.Errorf("want cached key after a failed refresh, got %v", err)
+	}
+	if _, err = verifier.key(context.Background(), "rotated"); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("want the fetch error for an unknown key, got %v", err)
+	}
+
+	verifier.fetched = time.Now().Add(-jwksCacheTTL - time.Minute)
+	verifier.attempted = time.Time{}
+	if _, err = verifier.key(context.Background(), "ci"); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("want expired keys refused, got %v", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	dir := t.TempDir()
+	defer func(file string) { defaultPolicyFile = file }(defaultPolicyFile)
+	defaultPolicyFile = filepath.Join(dir, "missing.yaml")
+
+	policyFile := filepath.Join(dir, "policy.yaml")
+	os.WriteFile(policyFile, []byte(`
+rules:
+- name: forks
+  when: {event: pull_request, repo: octo-org/secret-*}
+  deny: true
+- name: pull requests
+  when:
+    event: pull_request
+  repositories: [web]
+  permissions: {contents: read, pull_requests: write}
+- name: releases
+  when: {event: [push, tag], branch: main, repo: octo-org/*}
+  permissions: {contents: write}
+- name: production deploys
+  when: {event: promote, target: production, tag: v*}
+`), 0600)
+
+	build := func(event, branch, repo, target, tag string) Args {
+		args := Args{PolicyFile: policyFile}
+		args.Build.Event, args.Commit.Branch, args.Repo.Slug, args.Deploy.Target, args.Tag.Name = event, branch, repo, target, tag
+		args.Repo.Namespace = strings.SplitN(repo, "/", 2)[0]
+		return args
+	}
+	apply := func(args Args, opts githubapp.TokenOptions) (githubapp.TokenOptions, error) {
+		files, err := policyFiles(args)
+		if err != nil {
+			return opts, err
+		}
+		return applyPolicy(args, files, opts)
+	}
+	permissions := func(value string) map[string]string {
+		p, _ := parsePermissions(value)
+		return p
+	}
+
+	opts, err := apply(build("pull_request", "feature", "octo-org/web", "", ""), githubapp.TokenOptions{})
+	if err != nil || len(opts.Repositories) != 1 || opts.Permissions["pull_requests"] != "write" {
+		t.Errorf("want pull request token limited to the rule, got %+v, %v", opts, err)
+	}
+	_, err = apply(build("pull_request", "feature", "octo-org/web", "", ""), githubapp.TokenOptions{Permissions: permissions("contents:write,administration:write")})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the policy") || !strings.Contains(err.Error(), "event=pull_request") {
+		t.Errorf("want pull request with write permissions refused, got %v", err)
+	}
+	if _, err = apply(build("pull_request", "feature", "octo-org/secret-keys", "", ""), githubapp.TokenOptions{}); err == nil || !strings.Contains(err.Error(), "denies") {
+		t.Errorf("want denied rule to refuse the token, got %v", err)
+	}
+	if _, err = apply(build("push", "main", "octo-org/web", "", ""), githubapp.TokenOptions{Repositories: []string{"web", "api"}, Permissions: permissions("contents:write")}); err != nil {
+		t.Errorf("want push to main allowed, got %v", err)
+	}
+	if opts, err = apply(build("promote", "main", "octo-org/web", "production", "v1.2.0"), githubapp.TokenOptions{Permissions: permissions("administration:write")}); err != nil || opts.Permissions["administration"] != "write" {
+		t.Errorf("want unrestricted production deploy rule, got %+v, %v", opts, err)
+	}
+	if _, err = apply(build("push", "feature", "octo-org/web", "", ""), githubapp.TokenOptions{}); err == nil || !strings.Contains(err.Error(), "no policy rule") {
+		t.Errorf("want build matching no rule refused, got %v", err)
+	}
+
+	// names without an owner in the policy only match repositories of the
+	// pipeline owner
+	if _, err = apply(build("pull_request", "feature", "octo-org/web", "", ""), githubapp.TokenOptions{Repositories: []string{"octo-org/web"}}); err != nil {
+		t.Errorf("want owner/repo of the pipeline owner matched by the repository name, got %v", err)
+	}
+	if _, err = apply(build("pull_request", "feature", "octo-org/web", "", ""), githubapp.TokenOptions{Repositories: []string{"other-org/web"}}); err == nil {
+		t.Errorf("want repository of another owner refused")
+	}
+	if _, err = apply(build("pull_request", "feature", "octo-org/web", "", ""), githubapp.TokenOptions{Repositories: []string{"octo-org/api"}}); err == nil {
+		t.Errorf("want owner/repo outside the rule refused")
+	}
+
+	// the app jwt would get around the policy, and a denied build fails
+	// without an installation
+	args := build("pull_request", "feature", "octo-org/secret-keys", "", "")
+	args.AppId, args.JwtFile = "1", filepath.Join(dir, "jwt")
+	if err = Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "jwt_file") {
+		t.Errorf("want jwt_file refused with a policy file, got %v", err)
+	}
+	args.JwtFile = ""
+	args.Mode = "serve"
+	if err = Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "policy file") {
+		t.Errorf("want serve refused with a policy file, got %v", err)
+	}
+	args.Mode, args.EnvFile = "", filepath.Join(dir, "github.env")
+	if err = Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "denies") {
+		t.Errorf("want denied build refused without an installation, got %v", err)
+	}
+	for _, v := range envVars("https://api.github.com", "", "", githubapp.AppResponse{}, githubapp.TokenResponse{}) {
+		if v.Name == "GITHUB_APP_JWT" {
+			t.Errorf("want no GITHUB_APP_JWT without a jwt")
+		}
+	}
+
+	// the default policy file applies even when the pipeline sets its own
+	defaultPolicyFile = filepath.Join(dir, "default.yaml")
+	os.WriteFile(defaultPolicyFile, []byte("rules:\n- name: read only\n  permissions: {contents: read}\n"), 0600)
+	if _, err = apply(build("push", "main", "octo-org/web", "", ""), githubapp.TokenOptions{Permissions: permissions("contents:write")}); err == nil || !strings.Contains(err.Error(), "read only") {
+		t.Errorf("want default policy enforced, got %v", err)
+	}
+}
+
+func TestLeastPrivilege(t *testing.T) {
+	args := Args{Installation: "1", LeastPrivilege: true, AllowRepos: "docs, web"}
+	args.Repo.Namespace, args.Repo.Name = "octo-org", "web"
+
+	opts, err := tokenOptions(args)
+	if err != nil || strings.Join(opts.Repositories, ",") != "web,docs" || opts.Permissions["metadata"] != "read" || len(opts.Permissions) != 1 {
+		t.Errorf("want token scoped to the repository and allow_repos with metadata:read, got %+v, %v", opts, err)
+	}
+
+	args.Permissions = "contents:write"
+	args.RepoNames = "api"
+	if opts, err = tokenOptions(args); err != nil || strings.Join(opts.Repositories, ",") != "api" || opts.Permissions["contents"] != "write" {
+		t.Errorf("want explicit repositories and permissions kept, got %+v, %v", opts, err)
+	}
+
+	// the pipeline repository is not in installations of other owners
+	args = Args{InstallationOwner: "other-org", LeastPrivilege: true}
+	args.Repo.Namespace, args.Repo.Name = "octo-org", "web"
+	if _, err = tokenOptions(args); err == nil || !strings.Contains(err.Error(), "allow_repos") {
+		t.Errorf("want allow_repos required for other owners, got %v", err)
+	}
+
+	// an explicit installation of another owner is only known after the lookup
+	args = Args{Installation: "1", LeastPrivilege: true}
+	args.Repo.Namespace, args.Repo.Name = "octo-org", "web"
+	if opts, err = tokenOptions(args); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := leastPrivilegeInstallation(args, "Octo-Org", opts); err != nil || strings.Join(kept.Repositories, ",") != "web" {
+		t.Errorf("want pipeline repository kept for its owner, got %+v, %v", kept, err)
+	}
+	if _, err = leastPrivilegeInstallation(args, "other-org", opts); err == nil || !strings.Contains(err.Error(), "allow_repos") {
+		t.Errorf("want allow_repos required for another owner's installation, got %v", err)
+	}
+	args.AllowRepos = "docs"
+	if opts, err = tokenOptions(args); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := leastPrivilegeInstallation(args, "other-org", opts); err != nil || strings.Join(kept.Repositories, ",") != "docs" {
+		t.Errorf("want only allow_repos for another owner's installation, got %+v, %v", kept, err)
+	}
+
+	args = Args{InstallationOwner: "other-org"}
+	args.Repo.Namespace, args.Repo.Name = "octo-org", "web"
+	if opts, err = tokenOptions(args); err != nil || len(opts.Repositories) != 0 || len(opts.Permissions) != 0 {
+		t.Errorf("want tokens unchanged without least_privilege, got %+v, %v", opts, err)
+	}
+}
+
+func TestOwnerTokens(t *testing.T) {
+	if _, _, err := parseRepositoryData(Args{RepoNames: "octo-org/api,/web"}); err == nil {
+		t.Errorf("want error for a name without owner before the slash")
+	}
+
+	var revoked int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := githubapp.TokenOptions{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch path := strings.TrimPrefix(r.URL.Path, "/api/v3"); path {
+		case "/app":
+			w.Write([]byte(`{"id": 1, "slug": "drone"}`))
+		case "/orgs/octo-org/installation", "/app/installations/1":
+			w.Write([]byte(`{"id": 1, "account": {"login": "octo-org"}}`))
+		case "/orgs/other-org/installation", "/app/installations/2":
+			w.Write([]byte(`{"id": 2, "account": {"login": "other-org"}}`))
+		case "/app/installations/1/access_tokens", "/app/installations/2/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			if len(body.RepositoryIDs) == 0 {
+				w.Write([]byte(`{"token": "lookup", "expires_at": "2099-01-01T00:00:00Z"}`))
+				return
+			}
+			ids, _ := json.Marshal(body.RepositoryIDs)
+			fmt.Fprintf(w, `{"token": "token-%s-%s", "expires_at": "2099-01-01T00:00:00Z"}`, path[len("/app/installations/"):len("/app/installations/")+1], ids)
+		case "/repos/octo-org/api":
+			w.Write([]byte(`{"id": 10, "name": "api", "full_name": "octo-org/api", "owner": {"login": "octo-org"}}`))
+		case "/repos/octo-org/web":
+			// renamed, the redirect is followed by the client
+			w.Write([]byte(`{"id": 11, "name": "website", "full_name": "octo-org/website", "owner": {"login": "octo-org"}}`))
+		case "/repos/other-org/docs":
+			w.Write([]byte(`{"id": 20, "name": "docs", "full_name": "other-org/docs", "owner": {"login": "other-org"}}`))
+		case "/repos/other-org/moved":
+			w.Write([]byte(`{"id": 21, "name": "moved", "full_name": "elsewhere/moved", "owner": {"login": "elsewhere"}}`))
+		case "/installation/token":
+			revoked++
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	defer server.Close()
+	github := githubapp.NewClient(server.URL+"/api/v3", githubapp.NewHTTPClient(time.Second, 0))
+
+	// plain names belong to the pipeline repository owner
+	args := Args{RepoNames: "octo-org/api, other-org/docs, web"}
+	args.Repo.Namespace, args.Repo.Name = "octo-org", "web"
+	opts, err := tokenOptions(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := mintOwnerTokens(context.Background(), github, "jwt", "1", args, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Token.Token != "token-1-[10,11]" || tokens[1].Token.Token != "token-2-[20]" {
+		t.Errorf("want one token per owner scoped to repository ids, got %+v", tokens)
+	}
+	if revoked != 2 {
+		t.Errorf("want the lookup tokens revoked, got %d revocations", revoked)
+	}
+	vars := ownerTokenVars(tokens)
+	if len(vars) != 2 || vars[0].Name != "GITHUB_TOKEN_OCTO_ORG" || vars[1].Name != "GITHUB_TOKEN_OTHER_ORG" {
+		t.Errorf("want a variable per owner, got %+v", vars)
+	}
+
+	// plain names for a single installation are resolved to ids too
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jsonFile := filepath.Join(t.TempDir(), "token.json")
+	single := Args{AppId: "1", Pem: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})), APIURL: server.URL + "/api/v3", Installation: "1", RepoNames: "api, web", JsonFile: jsonFile, HTTPTimeout: time.Second}
+	if err = Exec(context.Background(), single); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(jsonFile)
+	output := JsonOutput{}
+	if json.Unmarshal(data, &output); output.Token.Token != "token-1-[10,11]" {
+		t.Errorf("want token scoped to the resolved repository ids, got %s", data)
+	}
+
+	// an explicit installation only covers its own account
+	args.Installation = "1"
+	if _, err = mintOwnerTokens(context.Background(), github, "jwt", "1", args, opts); err == nil || !strings.Contains(err.Error(), "does not belong to installation 1") {
+		t.Errorf("want error for repositories of other owners, got %v", err)
+	}
+
+	args = Args{Installation: "2", RepoNames: "other-org/moved"}
+	if opts, err = tokenOptions(args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mintOwnerTokens(context.Background(), github, "jwt", "1", args, opts); err == nil || !strings.Contains(err.Error(), "transferred") {
+		t.Errorf("want error for transferred repositories, got %v", err)
+	}
+}
+
+func TestSigners(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	sign := func(digest []byte) []byte {
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+		return signature
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		// aws kms
+		case r.Header.Get("X-Amz-Target") == "TrentService.GetPublicKey":
+			json.NewEncoder(w).Encode(map[string]interface{}{"PublicKey": publicDER})
+		case r.Header.Get("X-Amz-Target") == "TrentService.Sign":
+			digest, _ := base64.StdEncoding.DecodeString(body["Message"].(string))
+			json.NewEncoder(w).Encode(map[string]interface{}{"Signature": sign(digest)})
+		// gcp kms
+		case r.URL.Path == "/v1/projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1/publicKey":
+			json.NewEncoder(w).Encode(map[string]interface{}{"pem": publicPEM, "algorithm": "RSA_SIGN_PKCS1_2048_SHA256"})
+		case r.URL.Path == "/v1/projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1:asymmetricSign":
+			digest, _ := base64.StdEncoding.DecodeString(body["digest"].(map[string]interface{})["sha256"].(string))
+			json.NewEncoder(w).Encode(map[string]interface{}{"signature": sign(digest)})
+		// vault transit
+		case r.URL.Path == "/v1/transit/keys/github-app":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"type":           "rsa-2048",
+				"latest_version": 2,
+				"keys":           map[string]interface{}{"2": map[string]string{"public_key": publicPEM}},
+			}})
+		case r.URL.Path == "/v1/transit/sign/github-app/sha2-256" && body["prehashed"] == true:
+			digest, _ := base64.StdEncoding.DecodeString(body["input"].(string))
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+				"signature": "vault:v2:" + base64.StdEncoding.EncodeToString(sign(digest)),
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, args := range []Args{
+		{Signer: "aws-kms", SignerKey: "alias/github-app", AWSRegion: "us-east-1", AWSEndpoint: server.URL, AWSAccessKeyID: "AKID", AWSSecretAccessKey: "secret"},
+		{Signer: "gcp-kms", SignerKey: "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1", GCPAccessToken: "ya29.test", GCPKMSEndpoint: server.URL},
+		{Signer: "vault-transit", SignerKey: "github-app", VaultAddr: server.URL, VaultToken: "s.test", VaultTransitMount: "transit"},
+	} {
+		signer, err := newSigner(context.Background(), args)
+		if err != nil {
+			t.Errorf("%s: %v", args.Signer, err)
+			continue
+		}
+		token, err := githubapp.NewAppTokenSource("Iv1.test", signer).Token()
+		if err != nil {
+			t.Errorf("%s: %v", args.Signer, err)
+			continue
+		}
+		parts := strings.Split(token.AccessToken, ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("%s: want jwt signed by the remote key, got %v", args.Signer, err)
+		}
+	}
+
+	if _, err = newSigner(context.Background(), Args{Signer: "aws-kms"}); err == nil || !strings.Contains(err.Error(), "signer_key") {
+		t.Errorf("want signer_key required, got %v", err)
+	}
+}
+
+func TestPKCS11Signer(t *testing.T) {
+	util, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("needs softhsm2-util")
+	}
+	tool, err := exec.LookPath("pkcs11-tool")
+	if err != nil {
+		t.Skip("needs pkcs11-tool from opensc")
+	}
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range []string{"/usr/lib/softhsm/libsofthsm2.so", "/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so", "/usr/lib64/pkcs11/libsofthsm2.so", "/usr/local/lib/softhsm/libsofthsm2.so"} {
+		if _, err := os.Stat(path); module == "" && err == nil {
+			module = path
+		}
+	}
+	if module == "" {
+		t.Skip("needs the softhsm2 module, set SOFTHSM2_MODULE")
+	}
+
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "tokens"), 0700)
+	conf := filepath.Join(dir, "softhsm2.conf")
+	os.WriteFile(conf, []byte("directories.tokendir = "+filepath.Join(dir, "tokens")+"\nobjectstore.backend = file\n"), 0600)
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	publicDER, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	os.WriteFile(filepath.Join(dir, "public.der"), publicDER, 0600)
+
+	for _, command := range [][]string{
+		{util, "--init-token", "--free", "--label", "drone", "--pin", "1234", "--so-pin", "5678"},
+		{util, "--import", filepath.Join(dir, "key.pem"), "--token", "drone", "--label", "github-app", "--id", "01", "--pin", "1234"},
+		{tool, "--module", module, "--token-label", "drone", "--login", "--pin", "1234", "--write-object", filepath.Join(dir, "public.der"), "--type", "pubkey", "--label", "github-app", "--id", "01"},
+	} {
+		if out, err := exec.Command(command[0], command[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v: %s", command[0], err, out)
+		}
+	}
+
+	args := Args{Signer: "pkcs11", SignerKey: "github-app", PKCS11Module: module, PKCS11Token: "drone", PKCS11Pin: "1234", PKCS11Tool: tool}
+	signer, err := newSigner(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := githubapp.NewAppTokenSource("Iv1.test", signer).Token()
+	if err != nil {
+		t.Fatalf("want jwt signed with the token key, got %v", err)
+	}
+	parts := strings.Split(token.AccessToken, ".")
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("want jwt signed by the softhsm key, got %v", err)
+	}
+
+	args.PKCS11Pin = "0000"
+	signer, _ = newSigner(context.Background(), args)
+	if _, err = githubapp.NewAppTokenSource("Iv1.test", signer).Token(); err == nil || !strings.Contains(err.Error(), "CKR_PIN_INCORRECT") {
+		t.Errorf("want pkcs11-tool error surfaced, got %v", err)
+	}
+}
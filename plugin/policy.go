@@ -0,0 +1,156 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPolicyFile is always evaluated when it exists, so a policy baked
+// into the image or mounted by the runner cannot be bypassed by the pipeline
+var defaultPolicyFile = "/etc/drone-github-app/policy.yaml"
+
+// policyRule limits the tokens of builds matching all of its conditions
+type policyRule struct {
+	Name string `yaml:"name"`
+	When struct {
+		Event  globs `yaml:"event"`
+		Branch globs `yaml:"branch"`
+		Repo   globs `yaml:"repo"`
+		Target globs `yaml:"target"`
+		Tag    globs `yaml:"tag"`
+	} `yaml:"when"`
+	Deny         bool              `yaml:"deny"`         // refuse tokens for matching builds
+	Repositories []string          `yaml:"repositories"` // repositories the token may be scoped to, any when empty
+	Permissions  map[string]string `yaml:"permissions"`  // highest permission levels, any when empty
+}
+
+// policy is a policy file. The first rule matching the build applies, and
+// builds matching no rule get no token.
+type policy struct {
+	Rules []policyRule `yaml:"rules"`
+}
+
+// loadPolicy reads and validates a policy file
+func loadPolicy(file string) (*policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file: %v", err)
+	}
+
+	p := &policy{}
+	if err = yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file %s: %v", file, err)
+	}
+	if len(p.Rules) == 0 {
+		return nil, fmt.Errorf("policy file %s has no rules", file)
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d in policy file %s has no name", i+1, file)
+		}
+		for _, patterns := range []globs{rule.When.Event, rule.When.Branch, rule.When.Repo, rule.When.Target, rule.When.Tag} {
+			if err = patterns.validate(); err != nil {
+				return nil, fmt.Errorf("policy rule %s: %v", rule.Name, err)
+			}
+		}
+		for resource, permission := range rule.Permissions {
+			if permissionLevels[permission] == 0 {
+				return nil, fmt.Errorf("policy rule %s: invalid permission '%s:%s'", rule.Name, resource, permission)
+			}
+		}
+	}
+	return p, nil
+}
+
+// matches returns true if the build matches every condition of the rule
+func (r policyRule) matches(args Args) bool {
+	conditions := []struct {
+		patterns globs
+		value    string
+	}{
+		{r.When.Event, args.Build.Event},
+		{r.When.Branch, args.Commit.Branch},
+		{r.When.Repo, args.Repo.Slug},
+		{r.When.Target, args.Deploy.Target},
+		{r.When.Tag, args.Tag.Name},
+	}
+	for _, c := range conditions {
+		if len(c.patterns) > 0 && !c.patterns.match(c.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply limits the token scope to the first rule matching the build
+func (p *policy) apply(args Args, opts githubapp.TokenOptions) (githubapp.TokenOptions, error) {
+	build := fmt.Sprintf("event=%s branch=%s repo=%s target=%s tag=%s", args.Build.Event, args.Commit.Branch, args.Repo.Slug, args.Deploy.Target, args.Tag.Name)
+
+	for _, rule := range p.Rules {
+		if !rule.matches(args) {
+			continue
+		}
+		if rule.Deny {
+			return opts, fmt.Errorf("policy rule %s denies tokens for this build (%s)", rule.Name, build)
+		}
+
+		limited, err := limitTokenOptions("policy rule "+rule.Name, args.Repo.Namespace, rule.Repositories, rule.Permissions, opts)
+		if err != nil {
+			return opts, fmt.Errorf("token request exceeds the policy for this build (%s): %v", build, err)
+		}
+		log.Println(fmt.Sprintf("policy rule %s applies to this build", rule.Name))
+		return limited, nil
+	}
+	return opts, fmt.Errorf("no policy rule allows a token for this build (%s)", build)
+}
+
+// policyFiles returns the default policy file, when it exists, and
+// policy_file
+func policyFiles(args Args) ([]string, error) {
+	files := []string{}
+	if _, err := os.Stat(defaultPolicyFile); err == nil {
+		files = append(files, defaultPolicyFile)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read policy file: %v", err)
+	}
+	if args.PolicyFile != "" && args.PolicyFile != defaultPolicyFile {
+		files = append(files, args.PolicyFile)
+	}
+	return files, nil
+}
+
+// applyPolicy limits the token scope with the policy files, failing when the
+// build is denied or the request exceeds any of them
+func applyPolicy(args Args, files []string, opts githubapp.TokenOptions) (githubapp.TokenOptions, error) {
+	for _, file := range files {
+		p, err := loadPolicy(file)
+		if err != nil {
+			return opts, err
+		}
+		if opts, err = p.apply(args, opts); err != nil {
+			return opts, err
+		}
+	}
+
+	if len(files) > 0 {
+		var repositories []string
+		for _, id := range opts.RepositoryIDs {
+			repositories = append(repositories, fmt.Sprint(id))
+		}
+		repositories = append(repositories, opts.Repositories...)
+		log.Println(fmt.Sprintf("token allowed by policy, repositories: %s, permissions: %s", firstNonEmpty(strings.Join(repositories, ","), "all"), firstNonEmpty(formatPermissions(opts.Permissions), "all")))
+	}
+	return opts, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// revokedSecretValue replaces the token in secret sinks once revoked
+const revokedSecretValue = "revoked"
+
+// revoke revokes the installation tokens written by a previous step
+func revoke(ctx context.Context, args Args) error {
+	tokens, source, err := revokeTokens(args)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		log.Println(fmt.Sprintf("no token found in %s, nothing to revoke", source))
+		return nil
+	}
+
+	github, err := newClient(args)
+	if err != nil {
+		return err
+	}
+
+	// later steps sharing the cache would otherwise be handed a revoked
+	// token until it expires
+	var cache *tokenCache
+	if args.CacheDir != "" {
+		cache = newTokenCache(args.CacheDir, args.CacheKey, args.CacheMinLifetime)
+	}
+
+	// every token is revoked even when one fails
+	var failed error
+	for i, token := range tokens {
+		name := "token"
+		if len(tokens) > 1 {
+			name = fmt.Sprintf("token %d of %d", i+1, len(tokens))
+		}
+
+		err = github.RevokeInstallationToken(ctx, token)
+		var ghErr *githubapp.GitHubError
+		switch {
+		case errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnauthorized:
+			log.Println(fmt.Sprintf("%s from %s is already expired or revoked", name, source))
+		case err != nil:
+			log.Println(fmt.Sprintf("unable to revoke %s from %s: %v", name, source, err))
+			if failed == nil {
+				failed = err
+			}
+			continue
+		default:
+			log.Println(fmt.Sprintf("%s from %s revoked", name, source))
+		}
+
+		if cache != nil {
+			removed, err := cache.removeToken(token)
+			if err != nil {
+				return fmt.Errorf("unable to remove revoked token from cache: %v", err)
+			}
+			if removed > 0 {
+				log.Println(fmt.Sprintf("removed revoked %s from cache %s", name, args.CacheDir))
+			}
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	if args.TokenSecret == "" && args.JsonSecret == "" {
+		return nil
+	}
+
+	// the token is useless now, make sure later steps do not try to use it
+	sink, err := newSecretSink(ctx, args)
+	if err != nil {
+		return err
+	}
+	for _, secret := range []Secret{
+		{ID: args.TokenSecret, Kind: "token", Value: revokedSecretValue},
+		{ID: args.JsonSecret, Kind: "json", Value: revokedSecretValue},
+	} {
+		if secret.ID == "" {
+			continue
+		}
+		err = sink.Store(ctx, secret)
+		if err != nil {
+			return err
+		}
+		log.Println(fmt.Sprintf("cleared revoked token from %s", secret.ID))
+	}
+	return nil
+}
+
+// revokeTokens finds the tokens to revoke, returning where they were read
+// from. Files that do not exist return no tokens, as the step that should
+// have written them may have failed.
+func revokeTokens(args Args) (tokens []string, source string, err error) {
+	if args.RevokeToken != "" {
+		return []string{strings.TrimSpace(args.RevokeToken)}, "revoke_token", nil
+	}
+
+	var path string
+	switch {
+	case args.RevokeTokenFile != "":
+		path = args.RevokeTokenFile
+	case args.TokenFile != "":
+		path = args.TokenFile
+	case args.JsonFile != "":
+		path = args.JsonFile
+	default:
+		return nil, "", errors.New("one of revoke_token, revoke_token_file, token_file or json_file must be set to revoke a token")
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, path, nil
+	}
+	if err != nil {
+		return nil, path, err
+	}
+
+	// json files written by json_file hold the token alongside the jwt, and
+	// a token per owner when repo_names span several owners
+	var output JsonOutput
+	if json.Unmarshal(data, &output) == nil {
+		var owners []string
+		for owner := range output.Tokens {
+			owners = append(owners, owner)
+		}
+		sort.Strings(owners)
+
+		found := []string{output.Token.Token}
+		for _, owner := range owners {
+			found = append(found, output.Tokens[owner].Token)
+		}
+		seen := map[string]bool{"": true}
+		for _, token := range found {
+			if !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+		return tokens, path, nil
+	}
+
+	if token := strings.TrimSpace(string(data)); token != "" {
+		tokens = append(tokens, token)
+	}
+	return tokens, path, nil
+}
@@ -0,0 +1,611 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// permissionLevels orders permission levels so a requested level can be
+// compared to the highest level allowed
+var permissionLevels = map[string]int{"read": 1, "write": 2, "admin": 3}
+
+// brokerCaller is a client of the broker and what it may request
+type brokerCaller struct {
+	Name          string            `yaml:"name"`
+	TokenSHA256   string            `yaml:"token_sha256"`  // sha-256 of the caller's bearer token, hex encoded
+	ExpiresAt     time.Time         `yaml:"expires_at"`    // when the caller's token stops being accepted
+	Installations []int64           `yaml:"installations"` // installation ids the caller may request tokens for
+	Owners        []string          `yaml:"owners"`        // installation accounts the caller may request tokens for, * for any
+	Repositories  []string          `yaml:"repositories"`  // repositories the caller may request, any when empty
+	Permissions   map[string]string `yaml:"permissions"`   // highest permission levels the caller may request, any when empty
+}
+
+// brokerCallers is the callers file
+type brokerCallers struct {
+	Callers []*brokerCaller `yaml:"callers"`
+}
+
+// tokenRequest is the body of POST /token. The installation is the id, or is
+// looked up from the owner and optional repository.
+type tokenRequest struct {
+	Installation  int64             `json:"installation,omitempty"`
+	Owner         string            `json:"owner,omitempty"`
+	Repo          string            `json:"repo,omitempty"`
+	Repositories  []string          `json:"repositories,omitempty"`
+	RepositoryIDs []int             `json:"repository_ids,omitempty"`
+	Permissions   map[string]string `json:"permissions,omitempty"`
+}
+
+// brokerError is an error returned to the caller with its http status
+type brokerError struct {
+	status  int
+	message string
+}
+
+func (e *brokerError) Error() string {
+	return e.message
+}
+
+func newBrokerError(status int, format string, a ...interface{}) *brokerError {
+	return &brokerError{status: status, message: fmt.Sprintf(format, a...)}
+}
+
+// broker creates installation tokens for callers so only the broker holds
+// the app private key
+type broker struct {
+	github      *githubapp.Client
+	app         *githubapp.AppTokenSource
+	appData     githubapp.AppResponse
+	issuer      string
+	callers     map[string]*brokerCaller
+	oidc        *oidcVerifier
+	oidcRules   []oidcRule
+	minLifetime time.Duration
+	now         func() time.Time
+
+	mu            sync.Mutex
+	tokens        map[string]githubapp.TokenResponse
+	installations map[string]brokerInstallation
+}
+
+// installationCacheTTL is how long the broker reuses an installation lookup,
+// so uninstalled apps and transferred repositories are picked up
+const installationCacheTTL = 10 * time.Minute
+
+// brokerInstallation is an installation lookup cached by the broker
+type brokerInstallation struct {
+	githubapp.InstallationResponse
+	expires time.Time
+}
+
+// Serve runs the token broker until ctx is cancelled
+func Serve(ctx context.Context, args Args) error {
+	b, err := newBroker(ctx, args)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:              args.ServeAddr,
+		Handler:           b.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		log.Println(fmt.Sprintf("serving tokens on %s", args.ServeAddr))
+		if args.ServeTLSCert != "" {
+			errc <- server.ListenAndServeTLS(args.ServeTLSCert, args.ServeTLSKey)
+		} else {
+			errc <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdown)
+	}
+}
+
+// newBroker loads the callers and checks the app credentials before serving
+func newBroker(ctx context.Context, args Args) (*broker, error) {
+	// the broker mints tokens for its callers, not for a build, so a
+	// pipeline limited by a policy must not be able to start one
+	policies, err := policyFiles(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) > 0 {
+		return nil, fmt.Errorf("the broker cannot run with a policy file (%s): it would mint tokens outside the policy", strings.Join(policies, ", "))
+	}
+
+	if args.AppId == "" && args.ClientId == "" {
+		return nil, errors.New("either app_id or client_id needs to be set")
+	}
+	if args.ServeCallersFile == "" && args.OIDCRulesFile == "" {
+		return nil, errors.New("serve_callers_file or oidc_rules_file must be set to serve tokens")
+	}
+	if (args.ServeTLSCert == "") != (args.ServeTLSKey == "") {
+		return nil, errors.New("serve_tls_cert and serve_tls_key must be set together")
+	}
+
+	callers := map[string]*brokerCaller{}
+	if args.ServeCallersFile != "" {
+		callers, err = loadBrokerCallers(args.ServeCallersFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var verifier *oidcVerifier
+	var rules []oidcRule
+	if args.OIDCRulesFile != "" {
+		verifier, err = newOIDCVerifier(args)
+		if err != nil {
+			return nil, err
+		}
+		rules, err = loadOIDCRules(args.OIDCRulesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signers, err := newSigners(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := args.AppId
+	if args.ClientId != "" {
+		issuer = args.ClientId
+	}
+
+	github, err := newClient(args)
+	if err != nil {
+		return nil, err
+	}
+
+	app, _, appData, err := authenticateApp(ctx, github, issuer, signers)
+	if err != nil {
+		return nil, err
+	}
+	log.Println(fmt.Sprintf("authenticated as %s, %d callers, %d oidc rules", appData.Slug, len(callers), len(rules)))
+
+	return &broker{
+		github:        github,
+		app:           app,
+		appData:       appData,
+		issuer:        issuer,
+		callers:       callers,
+		oidc:          verifier,
+		oidcRules:     rules,
+		minLifetime:   args.CacheMinLifetime,
+		now:           time.Now,
+		tokens:        map[string]githubapp.TokenResponse{},
+		installations: map[string]brokerInstallation{},
+	}, nil
+}
+
+// loadBrokerCallers reads the callers file, returning the callers by the
+// hash of their token
+func loadBrokerCallers(path string) (map[string]*brokerCaller, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read serve_callers_file: %v", err)
+	}
+
+	file := brokerCallers{}
+	if err = yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse serve_callers_file: %v", err)
+	}
+
+	callers := map[string]*brokerCaller{}
+	for i, caller := range file.Callers {
+		if caller.Name == "" {
+			return nil, fmt.Errorf("caller %d in serve_callers_file has no name", i+1)
+		}
+		hash := strings.ToLower(caller.TokenSHA256)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("caller %s: token_sha256 must be the hex encoded sha-256 of the token", caller.Name)
+		}
+		if callers[hash] != nil {
+			return nil, fmt.Errorf("caller %s: token_sha256 is also used by caller %s", caller.Name, callers[hash].Name)
+		}
+		if err = validateBrokerCaller(caller); err != nil {
+			return nil, fmt.Errorf("caller %v", err)
+		}
+		callers[hash] = caller
+	}
+	return callers, nil
+}
+
+// validateBrokerCaller checks what the caller may request is valid
+func validateBrokerCaller(caller *brokerCaller) error {
+	if len(caller.Installations) == 0 && len(caller.Owners) == 0 {
+		return fmt.Errorf("%s: installations or owners must be set", caller.Name)
+	}
+	for resource, permission := range caller.Permissions {
+		if permissionLevels[permission] == 0 {
+			return fmt.Errorf("%s: invalid permission '%s:%s'", caller.Name, resource, permission)
+		}
+	}
+	return nil
+}
+
+// handler routes the broker endpoints
+func (b *broker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/token", b.tokenHandler(b.authenticate))
+	mux.Handle("/oidc/token", b.tokenHandler(b.authenticateOIDC))
+	return mux
+}
+
+// tokenHandler creates a token for a caller authenticated by authenticate,
+// within the caller's policy
+func (b *broker) tokenHandler(authenticate func(r *http.Request, entry *auditEntry) (*brokerCaller, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeBrokerError(w, newBrokerError(http.StatusMethodNotAllowed, "use POST"))
+			return
+		}
+
+		entry := auditEntry{Time: b.now().UTC(), Remote: r.RemoteAddr}
+		caller, err := authenticate(r, &entry)
+		var token githubapp.TokenResponse
+		if err == nil {
+			entry.Caller = caller.Name
+			token, err = b.serveToken(r, caller, &entry)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		entry.log()
+
+		if err != nil {
+			writeBrokerError(w, err)
+			return
+		}
+		// the app and installation are not part of the github token json,
+		// the plugin reads them for its outputs
+		w.Header().Set("X-GitHub-App-Id", strconv.Itoa(b.appData.ID))
+		w.Header().Set("X-GitHub-App-Slug", b.appData.Slug)
+		w.Header().Set("X-GitHub-App-Installation-Id", strconv.FormatInt(entry.Installation, 10))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(token)
+	})
+}
+
+// serveToken creates the token, recording what was requested and granted in
+// the audit entry
+func (b *broker) serveToken(r *http.Request, caller *brokerCaller, entry *auditEntry) (githubapp.TokenResponse, error) {
+	req := tokenRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return githubapp.TokenResponse{}, newBrokerError(http.StatusBadRequest, "invalid request: %v", err)
+	}
+
+	installation, err := b.installation(r.Context(), req)
+	if err != nil {
+		return githubapp.TokenResponse{}, err
+	}
+	entry.Installation = installation.ID
+	entry.Owner = installation.Account.Login
+
+	opts, err := authorizeToken(caller, installation, req)
+	if err != nil {
+		return githubapp.TokenResponse{}, err
+	}
+	entry.Repositories = opts.Repositories
+	entry.RepositoryIDs = opts.RepositoryIDs
+	entry.Permissions = opts.Permissions
+
+	token, cached, err := b.token(r.Context(), installation.ID, opts)
+	entry.Cached = cached
+	entry.ExpiresAt = token.ExpiresAt
+	return token, err
+}
+
+// authenticate returns the caller for the bearer token
+func (b *broker) authenticate(r *http.Request, entry *auditEntry) (*brokerCaller, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, newBrokerError(http.StatusUnauthorized, "missing bearer token")
+	}
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, "Bearer ")))
+
+	// the map lookup is on the hash, so it does not leak the token
+	caller := b.callers[hex.EncodeToString(sum[:])]
+	if caller == nil {
+		return nil, newBrokerError(http.StatusUnauthorized, "unknown bearer token")
+	}
+	if !caller.ExpiresAt.IsZero() && b.now().After(caller.ExpiresAt) {
+		return nil, newBrokerError(http.StatusUnauthorized, "bearer token of caller %s expired at %s", caller.Name, caller.ExpiresAt.Format(time.RFC3339))
+	}
+	return caller, nil
+}
+
+// authenticateOIDC verifies the bearer oidc token and returns the first rule
+// matching its claims as the caller
+func (b *broker) authenticateOIDC(r *http.Request, entry *auditEntry) (*brokerCaller, error) {
+	if b.oidc == nil {
+		return nil, newBrokerError(http.StatusNotFound, "oidc token exchange is not enabled")
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, newBrokerError(http.StatusUnauthorized, "missing bearer token")
+	}
+
+	claims, err := b.oidc.Verify(r.Context(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, newBrokerError(http.StatusUnauthorized, "%v", err)
+	}
+	entry.Subject, _ = claims["sub"].(string)
+	return matchOIDCRule(b.oidcRules, claims)
+}
+
+// installation returns the requested installation, looking it up by id or
+// owner and repository and reusing the lookup for installationCacheTTL
+func (b *broker) installation(ctx context.Context, req tokenRequest) (githubapp.InstallationResponse, error) {
+	key := strconv.FormatInt(req.Installation, 10)
+	switch {
+	case req.Installation != 0 && req.Owner != "":
+		return githubapp.InstallationResponse{}, newBrokerError(http.StatusBadRequest, "only one of installation or owner should be set")
+	case req.Installation == 0 && req.Owner == "":
+		return githubapp.InstallationResponse{}, newBrokerError(http.StatusBadRequest, "installation or owner must be set")
+	case req.Owner != "":
+		key = strings.ToLower(req.Owner + "/" + req.Repo)
+	}
+
+	b.mu.Lock()
+	cached, ok := b.installations[key]
+	b.mu.Unlock()
+	if ok && b.now().Before(cached.expires) {
+		return cached.InstallationResponse, nil
+	}
+
+	var installation githubapp.InstallationResponse
+	jwt, err := b.app.Token()
+	if err != nil {
+		return installation, err
+	}
+	if req.Owner != "" {
+		installation, err = b.github.FindInstallation(ctx, jwt.AccessToken, req.Owner, req.Repo)
+	} else {
+		installation, err = b.github.Installation(ctx, jwt.AccessToken, req.Installation)
+	}
+	if githubapp.IsNotFound(err) {
+		return installation, &brokerError{status: http.StatusNotFound, message: err.Error()}
+	}
+	if err != nil {
+		return installation, err
+	}
+
+	b.mu.Lock()
+	for k, cached := range b.installations {
+		if !b.now().Before(cached.expires) {
+			delete(b.installations, k)
+		}
+	}
+	b.installations[key] = brokerInstallation{InstallationResponse: installation, expires: b.now().Add(installationCacheTTL)}
+	b.mu.Unlock()
+	return installation, nil
+}
+
+// forgetInstallation drops the cached lookups of an installation, e.g. once
+// the app was uninstalled
+func (b *broker) forgetInstallation(id int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, cached := range b.installations {
+		if cached.ID == id {
+			delete(b.installations, k)
+		}
+	}
+}
+
+// authorizeToken checks the request against the caller's policy, returning
+// the token scope. Without repositories or permissions in the request the
+// token is scoped to everything the caller may request.
+func authorizeToken(caller *brokerCaller, installation githubapp.InstallationResponse, req tokenRequest) (githubapp.TokenOptions, error) {
+	allowed := false
+	for _, id := range caller.Installations {
+		allowed = allowed || id == installation.ID
+	}
+	for _, owner := range caller.Owners {
+		allowed = allowed || owner == "*" || strings.EqualFold(owner, installation.Account.Login)
+	}
+	if !allowed {
+		return githubapp.TokenOptions{}, newBrokerError(http.StatusForbidden, "caller %s may not request tokens for installation %d on %s", caller.Name, installation.ID, installation.Account.Login)
+	}
+
+	if len(req.Repositories) > 0 && len(req.RepositoryIDs) > 0 {
+		return githubapp.TokenOptions{}, newBrokerError(http.StatusBadRequest, "only one of repositories or repository_ids should be set")
+	}
+	for resource, permission := range req.Permissions {
+		if permissionLevels[permission] == 0 {
+			return githubapp.TokenOptions{}, newBrokerError(http.StatusBadRequest, "invalid permission '%s:%s': expected read, write or admin", resource, permission)
+		}
+	}
+
+	opts, err := limitTokenOptions("caller "+caller.Name, installation.Account.Login, caller.Repositories, caller.Permissions, githubapp.TokenOptions{
+		Repositories:  req.Repositories,
+		RepositoryIDs: req.RepositoryIDs,
+		Permissions:   req.Permissions,
+	})
+	if err != nil {
+		return opts, &brokerError{status: http.StatusForbidden, message: err.Error()}
+	}
+	return opts, nil
+}
+
+// repositoryAllowed returns true if repo, a name or owner/name, is in
+// allowed. Names in allowed without an owner only match repositories of
+// owner, other owners have to be listed as owner/name.
+func repositoryAllowed(allowed []string, owner, repo string) bool {
+	if containsFold(allowed, repo) {
+		return true
+	}
+	if i := strings.Index(repo, "/"); i >= 0 {
+		return owner != "" && strings.EqualFold(repo[:i], owner) && containsFold(allowed, repo[i+1:])
+	}
+	return false
+}
+
+// limitTokenOptions checks the token scope against the repositories and
+// highest permission levels allowed, when set. A scope without repositories
+// or permissions is limited to what is allowed. Allowed names without an
+// owner belong to owner.
+func limitTokenOptions(who, owner string, repositories []string, permissions map[string]string, opts githubapp.TokenOptions) (githubapp.TokenOptions, error) {
+	if len(repositories) > 0 {
+		if len(opts.RepositoryIDs) > 0 {
+			return opts, fmt.Errorf("%s may only request repositories by name", who)
+		}
+		if len(opts.Repositories) == 0 {
+			opts.Repositories = repositories
+		}
+		for _, repo := range opts.Repositories {
+			if !repositoryAllowed(repositories, owner, repo) {
+				return opts, fmt.Errorf("%s may not request repository %s, allowed: %s", who, repo, strings.Join(repositories, ", "))
+			}
+		}
+	}
+
+	if len(permissions) > 0 {
+		if len(opts.Permissions) == 0 {
+			opts.Permissions = permissions
+		}
+		for resource, permission := range opts.Permissions {
+			if permissionLevels[permission] > permissionLevels[permissions[resource]] {
+				return opts, fmt.Errorf("%s may not request %s:%s, allowed: %s", who, resource, permission, formatPermissions(permissions))
+			}
+		}
+	}
+	return opts, nil
+}
+
+// token returns a cached token for the scope, or creates one when there is
+// no cached token with enough lifetime left
+func (b *broker) token(ctx context.Context, installation int64, opts githubapp.TokenOptions) (githubapp.TokenResponse, bool, error) {
+	key := tokenCacheKey(b.github.BaseURL, b.issuer, installation, opts)
+
+	b.mu.Lock()
+	token, ok := b.tokens[key]
+	b.mu.Unlock()
+	if ok {
+		expiry, err := time.Parse(time.RFC3339, token.ExpiresAt)
+		if err == nil && expiry.Sub(b.now()) > b.minLifetime {
+			return token, true, nil
+		}
+	}
+
+	jwt, err := b.app.Token()
+	if err != nil {
+		return token, false, err
+	}
+	token, err = b.github.CreateInstallationToken(ctx, jwt.AccessToken, installation, opts)
+	if githubapp.IsNotFound(err) || githubapp.IsUnauthorized(err) {
+		// the installation is gone or suspended, look it up again next time
+		b.forgetInstallation(installation)
+	}
+	if githubapp.IsNotFound(err) {
+		return token, false, &brokerError{status: http.StatusNotFound, message: err.Error()}
+	}
+	if err != nil {
+		return token, false, err
+	}
+
+	b.mu.Lock()
+	for k, cached := range b.tokens {
+		if expiry, err := time.Parse(time.RFC3339, cached.ExpiresAt); err != nil || b.now().After(expiry) {
+			delete(b.tokens, k)
+		}
+	}
+	b.tokens[key] = token
+	b.mu.Unlock()
+	return token, false, nil
+}
+
+// auditEntry is logged as json for every token request
+type auditEntry struct {
+	Time          time.Time         `json:"time"`
+	Remote        string            `json:"remote"`
+	Caller        string            `json:"caller,omitempty"`
+	Subject       string            `json:"subject,omitempty"`
+	Installation  int64             `json:"installation,omitempty"`
+	Owner         string            `json:"owner,omitempty"`
+	Repositories  []string          `json:"repositories,omitempty"`
+	RepositoryIDs []int             `json:"repository_ids,omitempty"`
+	Permissions   map[string]string `json:"permissions,omitempty"`
+	Cached        bool              `json:"cached,omitempty"`
+	ExpiresAt     string            `json:"expires_at,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+func (e auditEntry) log() {
+	data, _ := json.Marshal(e)
+	log.Println(fmt.Sprintf("audit %s", data))
+}
+
+// writeBrokerError writes the error as json with its status, github and
+// other errors are returned as a bad gateway
+func writeBrokerError(w http.ResponseWriter, err error) {
+	status := http.StatusBadGateway
+	var brokerErr *brokerError
+	if errors.As(err, &brokerErr) {
+		status = brokerErr.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+// formatPermissions returns the permissions as sorted resource:level pairs
+func formatPermissions(permissions map[string]string) string {
+	var pairs []string
+	for resource, permission := range permissions {
+		pairs = append(pairs, resource+":"+permission)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// containsFold returns true if values contains value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
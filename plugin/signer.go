@@ -0,0 +1,517 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// sha256DigestInfo is the der prefix of a pkcs#1 v1.5 sha-256 signature,
+// needed when the token only does raw RSA-PKCS signing
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+// metadataTimeout limits requests to cloud instance metadata services, which
+// do not exist outside of the cloud
+const metadataTimeout = 2 * time.Second
+
+// gcpKMSScope is the oauth scope needed to sign with cloud kms
+const gcpKMSScope = "https://www.googleapis.com/auth/cloudkms"
+
+// newSigner returns the signer for app jwts selected by signer. By default
+// it is the private key from the pem settings, the other signers keep the
+// private key in a kms or hsm and only read its public key.
+func newSigner(ctx context.Context, args Args) (crypto.Signer, error) {
+	if args.Signer != "" && args.Signer != "pem" && args.SignerKey == "" {
+		return nil, fmt.Errorf("signer_key must be set for the %s signer", args.Signer)
+	}
+
+	switch args.Signer {
+	case "", "pem":
+		key, err := loadPrivateKey(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "pkcs11":
+		return newPKCS11Signer(ctx, args)
+	case "aws-kms":
+		return newAWSKMSSigner(ctx, args)
+	case "gcp-kms":
+		return newGCPKMSSigner(ctx, args)
+	case "vault-transit":
+		return newVaultTransitSigner(ctx, args)
+	default:
+		return nil, fmt.Errorf("unknown signer '%s': expected pem, pkcs11, aws-kms, gcp-kms or vault-transit", args.Signer)
+	}
+}
+
+// newSigners returns the signers to try in order. Only the pem signer can
+// have more than one key, the keys being rotated.
+func newSigners(ctx context.Context, args Args) ([]crypto.Signer, error) {
+	if args.Signer != "" && args.Signer != "pem" {
+		signer, err := newSigner(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+		return []crypto.Signer{signer}, nil
+	}
+
+	keys, err := loadPrivateKeys(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]crypto.Signer, len(keys))
+	for i, key := range keys {
+		signers[i] = key
+	}
+	return signers, nil
+}
+
+// keyFingerprint returns the sha-256 fingerprint of the public key, as shown
+// for the private keys in the app settings
+func keyFingerprint(public crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// authenticateApp signs a jwt with each signer in turn until github accepts
+// it, so pipelines keep working while a private key is rotated
+func authenticateApp(ctx context.Context, github *githubapp.Client, issuer string, signers []crypto.Signer) (*githubapp.AppTokenSource, *oauth2.Token, githubapp.AppResponse, error) {
+	var err error
+	for i, signer := range signers {
+		fingerprint := keyFingerprint(signer.Public())
+		app := githubapp.NewAppTokenSource(issuer, signer)
+
+		var appToken *oauth2.Token
+		appToken, err = app.Token()
+		if err != nil {
+			return nil, nil, githubapp.AppResponse{}, err
+		}
+
+		var appData githubapp.AppResponse
+		appData, err = github.App(ctx, appToken.AccessToken)
+		if githubapp.IsUnauthorized(err) && i < len(signers)-1 {
+			log.Println(fmt.Sprintf("key %s was rejected by github, trying the next key", fingerprint))
+			continue
+		}
+		if err != nil {
+			return nil, nil, githubapp.AppResponse{}, err
+		}
+
+		log.Println(fmt.Sprintf("signed with key %s", fingerprint))
+		if i > 0 {
+			log.Println(fmt.Sprintf("warning: the primary key %s was rejected and fallback key %s was used, finish rotating the private key", keyFingerprint(signers[0].Public()), fingerprint))
+		}
+		return app, appToken, appData, nil
+	}
+	return nil, nil, githubapp.AppResponse{}, err
+}
+
+// remoteSigner is a crypto.Signer for a key that never leaves the service
+// holding it
+type remoteSigner struct {
+	public *rsa.PublicKey
+	sign   func(digest []byte) ([]byte, error)
+}
+
+// newRemoteSigner returns a signer for the public key, which must be rsa
+func newRemoteSigner(name string, public crypto.PublicKey, sign func(digest []byte) ([]byte, error)) (*remoteSigner, error) {
+	rsaPublic, ok := public.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s key is a %T: github apps use rsa keys", name, public)
+	}
+	return &remoteSigner{public: rsaPublic, sign: sign}, nil
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign signs a sha-256 digest with pkcs#1 v1.5 padding, the only signature
+// github accepts
+func (s *remoteSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash %v: only sha-256 is supported", opts.HashFunc())
+	}
+	signature, err := s.sign(digest)
+	if err != nil {
+		return nil, err
+	}
+	// a signature from the wrong key would only fail later at github
+	if err = rsa.VerifyPKCS1v15(s.public, crypto.SHA256, digest, signature); err != nil {
+		return nil, fmt.Errorf("signature does not match the public key: %v", err)
+	}
+	return signature, nil
+}
+
+// parsePublicKey parses a der or pem public key in pkix or pkcs#1 format
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS1PublicKey(data)
+}
+
+// pkcs11PinEnv passes the pin to pkcs11-tool, which reads it with
+// --pin env:NAME, so it is not on the command line for other users to see
+const pkcs11PinEnv = "DRONE_GITHUB_APP_PKCS11_PIN"
+
+// newPKCS11Signer signs with a key on a pkcs#11 token using pkcs11-tool
+// from opensc, as the plugin is built without cgo
+func newPKCS11Signer(ctx context.Context, args Args) (*remoteSigner, error) {
+	if args.PKCS11Module == "" {
+		return nil, errors.New("pkcs11_module must be set for the pkcs11 signer")
+	}
+
+	tool := firstNonEmpty(args.PKCS11Tool, "pkcs11-tool")
+	base := []string{"--module", args.PKCS11Module}
+	switch {
+	case args.PKCS11Token != "":
+		base = append(base, "--token-label", args.PKCS11Token)
+	case args.PKCS11Slot != "":
+		base = append(base, "--slot", args.PKCS11Slot)
+	}
+	// signer_key is the key label, or its hex id when prefixed with id:
+	if id := strings.TrimPrefix(args.SignerKey, "id:"); id != args.SignerKey {
+		if _, err := hex.DecodeString(id); err != nil {
+			return nil, fmt.Errorf("invalid pkcs11 key id '%s': expected hex", id)
+		}
+		base = append(base, "--id", id)
+	} else {
+		base = append(base, "--label", args.SignerKey)
+	}
+
+	dir, err := os.MkdirTemp("", "drone-github-app-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(extra ...string) error {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, tool, append(append([]string{}, base...), extra...)...)
+		cmd.Env = append(os.Environ(), pkcs11PinEnv+"="+args.PKCS11Pin)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s failed: %v: %s", tool, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+
+	publicFile := filepath.Join(dir, "public.der")
+	if err = run("--read-object", "--type", "pubkey", "--output-file", publicFile); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(publicFile)
+	if err != nil {
+		return nil, err
+	}
+	public, err := parsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pkcs11 public key: %v", err)
+	}
+
+	return newRemoteSigner("pkcs11", public, func(digest []byte) ([]byte, error) {
+		dir, err := os.MkdirTemp("", "drone-github-app-pkcs11-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		input := filepath.Join(dir, "digest")
+		output := filepath.Join(dir, "signature")
+		if err = os.WriteFile(input, append(append([]byte{}, sha256DigestInfo...), digest...), 0600); err != nil {
+			return nil, err
+		}
+
+		signArgs := []string{"--sign", "--mechanism", "RSA-PKCS", "--input-file", input, "--output-file", output}
+		if args.PKCS11Pin != "" {
+			signArgs = append(signArgs, "--login", "--pin", "env:"+pkcs11PinEnv)
+		}
+		if err = run(signArgs...); err != nil {
+			return nil, err
+		}
+		return os.ReadFile(output)
+	})
+}
+
+// newAWSKMSSigner signs with an asymmetric aws kms key
+func newAWSKMSSigner(ctx context.Context, args Args) (*remoteSigner, error) {
+	cfg, err := awsConfig(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	client := kms.NewFromConfig(cfg)
+
+	publicKey, err := client.GetPublicKey(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(args.SignerKey)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get aws kms public key: %v", err)
+	}
+	public, err := x509.ParsePKIXPublicKey(publicKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse aws kms public key: %v", err)
+	}
+
+	return newRemoteSigner("aws kms", public, func(digest []byte) ([]byte, error) {
+		signed, err := client.Sign(ctx, &kms.SignInput{
+			KeyId:            aws.String(args.SignerKey),
+			Message:          digest,
+			MessageType:      kmstypes.MessageTypeDigest,
+			SigningAlgorithm: kmstypes.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("aws kms sign failed: %v", err)
+		}
+		return signed.Signature, nil
+	})
+}
+
+// newGCPKMSSigner signs with a cloud kms asymmetric key version, signer_key
+// is the full name projects/.../cryptoKeyVersions/N
+func newGCPKMSSigner(ctx context.Context, args Args) (*remoteSigner, error) {
+	tokens, err := gcpTokenSource(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.TrimRight(firstNonEmpty(args.GCPKMSEndpoint, "https://cloudkms.googleapis.com"), "/")
+	client := &http.Client{Transport: &oauth2.Transport{
+		Source: oauth2.ReuseTokenSource(nil, tokens),
+		Base:   githubapp.NewRetryClient(args.HTTPTimeout, args.HTTPRetries).Transport,
+	}}
+
+	call := func(method, path string, body, out interface{}) error {
+		var reqBody io.Reader
+		if body != nil {
+			data, err := json.Marshal(body)
+			if err != nil {
+				return err
+			}
+			reqBody = bytes.NewReader(data)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, endpoint+"/v1/"+path, reqBody)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			status := struct {
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}{}
+			json.Unmarshal(data, &status)
+			return fmt.Errorf("cloud kms returned %s: %s", resp.Status, status.Error.Message)
+		}
+		return json.Unmarshal(data, out)
+	}
+
+	publicKey := struct {
+		Pem       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}{}
+	if err = call("GET", args.SignerKey+"/publicKey", nil, &publicKey); err != nil {
+		return nil, fmt.Errorf("unable to get gcp kms public key: %v", err)
+	}
+	if !strings.HasPrefix(publicKey.Algorithm, "RSA_SIGN_PKCS1_") || !strings.HasSuffix(publicKey.Algorithm, "_SHA256") {
+		return nil, fmt.Errorf("gcp kms key algorithm is %s: github apps need an RSA_SIGN_PKCS1_*_SHA256 key", publicKey.Algorithm)
+	}
+	public, err := parsePublicKey([]byte(publicKey.Pem))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse gcp kms public key: %v", err)
+	}
+
+	return newRemoteSigner("gcp kms", public, func(digest []byte) ([]byte, error) {
+		signed := struct {
+			Signature []byte `json:"signature"`
+		}{}
+		err := call("POST", args.SignerKey+":asymmetricSign", map[string]interface{}{
+			"digest": map[string][]byte{"sha256": digest},
+		}, &signed)
+		if err != nil {
+			return nil, fmt.Errorf("gcp kms sign failed: %v", err)
+		}
+		return signed.Signature, nil
+	})
+}
+
+// gcpTokenSource returns access tokens from gcp_access_token, a service
+// account key file or the metadata server
+func gcpTokenSource(ctx context.Context, args Args) (oauth2.TokenSource, error) {
+	if args.GCPAccessToken != "" {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: args.GCPAccessToken}), nil
+	}
+
+	if path := firstNonEmpty(args.GCPCredentialsFile, os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gcp credentials: %v", err)
+		}
+		key := struct {
+			Type         string `json:"type"`
+			ClientEmail  string `json:"client_email"`
+			PrivateKey   string `json:"private_key"`
+			PrivateKeyID string `json:"private_key_id"`
+			TokenURI     string `json:"token_uri"`
+		}{}
+		if err = json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("unable to parse gcp credentials: %v", err)
+		}
+		if key.Type != "service_account" {
+			return nil, fmt.Errorf("gcp credentials of type '%s' are not supported: use a service account key, gcp_access_token or the metadata server", key.Type)
+		}
+		config := &jwt.Config{
+			Email:        key.ClientEmail,
+			PrivateKey:   []byte(key.PrivateKey),
+			PrivateKeyID: key.PrivateKeyID,
+			Scopes:       []string{gcpKMSScope},
+			TokenURL:     firstNonEmpty(key.TokenURI, "https://oauth2.googleapis.com/token"),
+		}
+		return config.TokenSource(ctx), nil
+	}
+
+	return oauth2.ReuseTokenSource(nil, &gcpMetadataTokenSource{ctx: ctx}), nil
+}
+
+// gcpMetadataTokenSource gets tokens for the service account of the gce
+// instance or gke workload
+type gcpMetadataTokenSource struct {
+	ctx context.Context
+}
+
+func (s *gcpMetadataTokenSource) Token() (*oauth2.Token, error) {
+	host := firstNonEmpty(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal")
+	u := fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/token?scopes=%s", host, url.QueryEscape(gcpKMSScope))
+	req, err := http.NewRequestWithContext(s.ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		TokenType   string `json:"token_type"`
+	}{}
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%s returned %s", req.URL.Path, resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&token)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no gcp credentials found: set gcp_access_token or gcp_credentials_file (metadata server: %v)", err)
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// newVaultTransitSigner signs with a vault transit rsa key
+func newVaultTransitSigner(ctx context.Context, args Args) (*remoteSigner, error) {
+	client, err := newVaultClient(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	mount := strings.Trim(args.VaultTransitMount, "/")
+
+	resp, err := client.request(ctx, "GET", fmt.Sprintf("%s/keys/%s", mount, args.SignerKey), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get vault transit key: %v", err)
+	}
+	key := struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	}{}
+	if err = json.Unmarshal(resp.Data, &key); err != nil {
+		return nil, fmt.Errorf("unable to decode vault transit key: %v", err)
+	}
+	if !strings.HasPrefix(key.Type, "rsa-") {
+		return nil, fmt.Errorf("vault transit key type is %s: github apps need an rsa key", key.Type)
+	}
+	public, err := parsePublicKey([]byte(key.Keys[fmt.Sprint(key.LatestVersion)].PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse vault transit public key: %v", err)
+	}
+
+	return newRemoteSigner("vault transit", public, func(digest []byte) ([]byte, error) {
+		resp, err := client.request(ctx, "POST", fmt.Sprintf("%s/sign/%s/sha2-256", mount, args.SignerKey), map[string]interface{}{
+			"input":               base64.StdEncoding.EncodeToString(digest),
+			"prehashed":           true,
+			"signature_algorithm": "pkcs1v15",
+			"key_version":         key.LatestVersion,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("vault transit sign failed: %v", err)
+		}
+		signed := struct {
+			Signature string `json:"signature"`
+		}{}
+		if err = json.Unmarshal(resp.Data, &signed); err != nil {
+			return nil, err
+		}
+		// signatures are vault:v<version>:<base64>
+		parts := strings.SplitN(signed.Signature, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("unexpected vault transit signature '%s'", signed.Signature)
+		}
+		return base64.StdEncoding.DecodeString(parts[2])
+	})
+}
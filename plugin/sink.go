@@ -0,0 +1,58 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Secret is a credential written to a secret sink
+type Secret struct {
+	// ID identifies the secret in the sink, e.g. jwt_secret or token_secret
+	ID string
+
+	// Kind is what the secret holds: jwt, token or json
+	Kind string
+
+	// Value is the secret content
+	Value string
+
+	// ExpiresAt is when the credential stops working, zero if unknown
+	ExpiresAt time.Time
+
+	// App and Installation describe where the credential came from, when
+	// known
+	App          string
+	Installation string
+}
+
+// SecretSink stores secrets outside of the workspace
+type SecretSink interface {
+	// Name describes the sink in logs and the card
+	Name() string
+
+	// Store creates or updates the secret
+	Store(ctx context.Context, secret Secret) error
+}
+
+// newSecretSink returns the sink selected by secret_sink
+func newSecretSink(ctx context.Context, args Args) (SecretSink, error) {
+	switch args.SecretSink {
+	case "", "harness":
+		return newHarnessSink(args)
+	case "vault":
+		return newVaultSink(ctx, args)
+	case "kubernetes":
+		return newKubernetesSink(args)
+	case "aws-secrets-manager":
+		return newSecretsManagerSink(ctx, args)
+	case "aws-ssm":
+		return newSSMSink(ctx, args)
+	default:
+		return nil, fmt.Errorf("unknown secret_sink '%s': expected harness, vault, kubernetes, aws-secrets-manager or aws-ssm", args.SecretSink)
+	}
+}
@@ -5,14 +5,16 @@
 package plugin
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
+	"strings"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
 )
 
 func writeCard(path, schema string, card interface{}) {
@@ -38,87 +40,27 @@ func writeCardTo(out io.Writer, data []byte) {
 	io.WriteString(out, "\n")
 }
 
-// validateJWT retives information on the github app to verify the jwt is valid
-func validateJWT(jwt string) (response AppResponse, err error) {
-	req, err := http.NewRequest("GET", "https://api.github.com/app", nil)
-	if err != nil {
-		return
+// resolveAPIURL determines the github api base url for the plugin. An explicit
+// api_url is normalized, otherwise the url is derived from the repository link
+// when it is github.com, a ghe.com tenant or one of github_hosts. Other hosts, e.g. gitlab or gitea, use https://api.github.com.
+func resolveAPIURL(args Args) (string, error) {
+	if args.APIURL != "" {
+		return githubapp.NormalizeAPIURL(args.APIURL)
 	}
 
-	req.Header.Add("Accept", "application/vnd.github+json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", jwt))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return
-	}
-
-	return
-}
-
-// installationToken returns a github pat for the given installation scope
-// If repoData is provided, the token will be scoped to those repositories
-// If permissions is provided, the token will have those specific permissions
-func installationToken(jwt, installation string, repoData map[string]interface{}, permissions map[string]string) (response TokenResponse, err error) {
-	var reqBody *bytes.Buffer
-	
-	// Build request data with repositories and/or permissions if provided
-	// Expected JSON structure:
-	// {
-	//   "repositories": ["repo1", "repo2"] OR "repository_ids": [1001, 1002],
-	//   "permissions": {"contents": "read", "issues": "write"}
-	// }
-	reqData := make(map[string]interface{})
-	
-	if repoData != nil {
-		for key, value := range repoData {
-			reqData[key] = value
+	for _, link := range []string{args.Repo.Link, args.Git.HTTPURL} {
+		if link == "" {
+			continue
 		}
-	}
-	
-	if permissions != nil && len(permissions) > 0 {
-		reqData["permissions"] = permissions
-	}
-	
-	if len(reqData) > 0 {
-		jsonData, err := json.Marshal(reqData)
-		if err != nil {
-			return response, err
+		u, err := url.Parse(link)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if host == "github.com" || strings.HasSuffix(host, ".ghe.com") || containsFold(args.GitHubHosts, host) || containsFold(args.GitHubHosts, strings.ToLower(u.Host)) {
+			return githubapp.NormalizeAPIURL(fmt.Sprintf("%s://%s", u.Scheme, u.Host))
 		}
-		reqBody = bytes.NewBuffer(jsonData)
-	} else {
-		reqBody = bytes.NewBuffer([]byte{})
-	}
-	
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://api.github.com/app/installations/%s/access_tokens", installation), reqBody)
-	if err != nil {
-		return
-	}
-
-	req.Header.Add("Accept", "application/vnd.github+json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", jwt))
-	if len(reqData) > 0 {
-		req.Header.Add("Content-Type", "application/json")
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return
 	}
 
-	return
+	return githubapp.DefaultAPIURL, nil
 }
@@ -0,0 +1,231 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+// Use of this source code is governed by the Blue Oak Model License
+// that can be found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.om/rssnyder/drone-github-app/githubapp"
+)
+
+// vaultClient makes requests against the vault http api
+type vaultClient struct {
+	addr      string
+	namespace string
+	token     string
+	client    *http.Client
+}
+
+// vaultResponse is the envelope of vault responses
+type vaultResponse struct {
+	Data json.RawMessage `json:"data"`
+	Auth struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// newVaultClient returns a client authenticated with the configured auth
+// method
+func newVaultClient(ctx context.Context, args Args) (*vaultClient, error) {
+	addr := firstNonEmpty(args.VaultAddr, os.Getenv("VAULT_ADDR"))
+	if addr == "" {
+		return nil, errors.New("vault_addr must be set to use vault")
+	}
+
+	c := &vaultClient{
+		addr:      strings.TrimRight(addr, "/"),
+		namespace: firstNonEmpty(args.VaultNamespace, os.Getenv("VAULT_NAMESPACE")),
+		client:    githubapp.NewRetryClient(args.HTTPTimeout, args.HTTPRetries),
+	}
+
+	method := args.VaultAuthMethod
+	mount := firstNonEmpty(args.VaultAuthMount, method)
+
+	var login map[string]string
+	switch method {
+	case "", "token":
+		c.token = firstNonEmpty(args.VaultToken, os.Getenv("VAULT_TOKEN"))
+		if c.token == "" {
+			return nil, errors.New("vault_token must be set for vault token auth")
+		}
+		return c, nil
+	case "approle":
+		if args.VaultRoleID == "" || args.VaultSecretID == "" {
+			return nil, errors.New("vault_role_id and vault_secret_id must be set for vault approle auth")
+		}
+		login = map[string]string{"role_id": args.VaultRoleID, "secret_id": args.VaultSecretID}
+	case "kubernetes":
+		if args.VaultRole == "" {
+			return nil, errors.New("vault_role must be set for vault kubernetes auth")
+		}
+		jwt, err := os.ReadFile(args.VaultJWTFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read service account token for vault kubernetes auth: %v", err)
+		}
+		login = map[string]string{"role": args.VaultRole, "jwt": strings.TrimSpace(string(jwt))}
+	default:
+		return nil, fmt.Errorf("unknown vault_auth_method '%s': expected token, approle or kubernetes", method)
+	}
+
+	resp, err := c.request(ctx, "POST", fmt.Sprintf("auth/%s/login", mount), login)
+	if err != nil {
+		return nil, fmt.Errorf("vault %s login failed: %v", method, err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault %s login returned no token", method)
+	}
+	c.token = resp.Auth.ClientToken
+
+	return c, nil
+}
+
+// request makes a request to the vault api path, below /v1
+func (c *vaultClient) request(ctx context.Context, method, path string, body interface{}) (*vaultResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s", c.addr, strings.TrimLeft(path, "/")), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	vaultResp := &vaultResponse{}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, vaultResp); err != nil && resp.StatusCode < 300 {
+			return nil, fmt.Errorf("unable to decode vault response: %v", err)
+		}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(vaultResp.Errors) > 0 {
+			return nil, fmt.Errorf("vault returned %s for %s: %s", resp.Status, path, strings.Join(vaultResp.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+	return vaultResp, nil
+}
+
+// vaultSink stores secrets in a vault kv secrets engine
+type vaultSink struct {
+	client    *vaultClient
+	mount     string
+	kvVersion int
+	field     string
+}
+
+// newVaultSink returns a sink writing to the configured kv mount
+func newVaultSink(ctx context.Context, args Args) (*vaultSink, error) {
+	if args.VaultKVVersion != 1 && args.VaultKVVersion != 2 {
+		return nil, fmt.Errorf("invalid vault_kv_version %d: expected 1 or 2", args.VaultKVVersion)
+	}
+
+	client, err := newVaultClient(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &vaultSink{
+		client:    client,
+		mount:     strings.Trim(args.VaultMount, "/"),
+		kvVersion: args.VaultKVVersion,
+		field:     args.VaultField,
+	}, nil
+}
+
+func (s *vaultSink) Name() string {
+	return "vault"
+}
+
+// Store writes the secret value and its expiry. In kv v2 the expiry is also
+// recorded in the custom metadata and old versions are deleted once the
+// credential expires. In kv v1 the ttl is set as the lease hint.
+func (s *vaultSink) Store(ctx context.Context, secret Secret) error {
+	path := strings.Trim(secret.ID, "/")
+	data := map[string]interface{}{
+		s.field: secret.Value,
+	}
+
+	var ttl time.Duration
+	var expiresAt string
+	if !secret.ExpiresAt.IsZero() {
+		ttl = time.Until(secret.ExpiresAt).Round(time.Second)
+		expiresAt = secret.ExpiresAt.UTC().Format(time.RFC3339)
+		data["expires_at"] = expiresAt
+	}
+
+	if s.kvVersion == 1 {
+		if ttl > 0 {
+			data["ttl"] = ttl.String()
+		}
+		_, err := s.client.request(ctx, "POST", fmt.Sprintf("%s/%s", s.mount, path), data)
+		return err
+	}
+
+	_, err := s.client.request(ctx, "POST", fmt.Sprintf("%s/data/%s", s.mount, path), map[string]interface{}{
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]interface{}{
+		"custom_metadata": map[string]string{
+			"kind":       secret.Kind,
+			"expires_at": expiresAt,
+			"created_by": "drone-github-app",
+		},
+	}
+	if ttl > 0 {
+		metadata["delete_version_after"] = ttl.String()
+	}
+	_, err = s.client.request(ctx, "POST", fmt.Sprintf("%s/metadata/%s", s.mount, path), metadata)
+	return err
+}
+
+// firstNonEmpty returns the first value that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}